@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// actions recorded in the audit log
+const (
+	auditBan             = "user.ban"
+	auditUnban           = "user.unban"
+	auditRoleGrant       = "role.grant"
+	auditRoleRevoke      = "role.revoke"
+	auditAppealAccept    = "appeal.accept"
+	auditAppealReject    = "appeal.reject"
+	auditProductApprove  = "product.approve"
+	auditProductReject   = "product.reject"
+	auditProductTakedown = "product.takedown"
+	auditProductRestore  = "product.restore"
+	auditPricingSet      = "pricing.set"
+	auditPricingDelete   = "pricing.delete"
+	auditClockSet        = "clock.set"
+	auditClockAdvance    = "clock.advance"
+	auditWorldCreate     = "world.create"
+	auditWorldClone      = "world.clone"
+	auditWorldReset      = "world.reset"
+	auditSnapshotRestore = "snapshot.restore"
+)
+
+// context key of the request id set by requestId
+const requestKey = "requestId"
+
+// the request id is also stored in the request's context so functions taking only a context can audit
+type requestIdKey struct{}
+
+// Exec of *sql.DB and *sql.Tx, audit entries are written in the transaction of the action when there is one
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// tags the request with the client's X-Request-Id or a new random id and echoes it in the response
+func requestId(c *gin.Context) {
+	id := c.GetHeader("X-Request-Id")
+	if id == "" || len(id) > 64 {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+	c.Set(requestKey, id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIdKey{}, id))
+	c.Header("X-Request-Id", id)
+	c.Next()
+}
+
+// appends an entry to the audit log, actor is empty for jobs and commands and before or after is nil when there is no value.
+// resets and restores recycle ids, so entries carry the number of them logged in their world before, entries of an older
+// epoch refer to rows of the data that was replaced
+func audit(ctx context.Context, db execer, world string, actor string, action string, targetType string, targetId string, before any, after any) error {
+	values := make([]sql.NullString, 2)
+	for i, value := range []any{before, after} {
+		if value == nil {
+			continue
+		}
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[i] = sql.NullString{String: string(buf), Valid: true}
+	}
+	request, _ := ctx.Value(requestIdKey{}).(string)
+	_, err := db.ExecContext(ctx, "INSERT INTO AuditLog(world_id, actor_id, action, target_type, target_id, before, after, request_id, created, epoch)"+
+		" VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, (SELECT COUNT(*) FROM AuditLog WHERE world_id = $1 AND action IN ($10, $11)));",
+		world, nullable(actor), action, targetType, targetId, values[0], values[1], nullable(request), clock.Now(), auditWorldReset, auditSnapshotRestore)
+	return err
+}
+
+// audit log across worlds, newest first, filtered by world, actor, action, target, request, epoch and time
+func auditGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	filter := ""
+	args := []any{}
+	for _, term := range [...]string{"world_id", "actor_id", "action", "target_type", "target_id", "request_id", "epoch"} {
+		if value := c.Query(term); value != "" {
+			args = append(args, value)
+			filter += " AND " + term + "::text = $" + strconv.Itoa(len(args))
+		}
+	}
+	if value := c.Query("from"); value != "" {
+		args = append(args, value)
+		filter += " AND created >= $" + strconv.Itoa(len(args))
+	}
+	if value := c.Query("to"); value != "" {
+		args = append(args, value)
+		filter += " AND created < $" + strconv.Itoa(len(args))
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	type entry struct {
+		Id         string          `json:"id"`
+		World      string          `json:"world"`
+		Actor      string          `json:"actor,omitempty"`
+		Action     string          `json:"action"`
+		TargetType string          `json:"targetType"`
+		TargetId   string          `json:"targetId"`
+		Before     json.RawMessage `json:"before,omitempty"`
+		After      json.RawMessage `json:"after,omitempty"`
+		Request    string          `json:"requestId,omitempty"`
+		Epoch      int             `json:"epoch"`
+		Timestamp  string          `json:"timestamp"`
+	}
+	var entries []entry
+	rows, err := db.Query("SELECT id, world_id, COALESCE(actor_id::text, ''), action, target_type, target_id, COALESCE(before::text, ''),"+
+		" COALESCE(after::text, ''), COALESCE(request_id, ''), epoch, created FROM AuditLog WHERE TRUE"+filter+
+		" ORDER BY created DESC, id DESC LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", args...)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e entry
+		var before, after string
+		if err := rows.Scan(&e.Id, &e.World, &e.Actor, &e.Action, &e.TargetType, &e.TargetId, &before, &after, &e.Request, &e.Epoch, &e.Timestamp); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	//current epoch of each world, entries of earlier ones name ids from before the last reset or restore
+	epochs := map[string]int{}
+	epochRows, err := db.Query("SELECT world_id, COUNT(*) FROM AuditLog WHERE action IN ($1, $2) GROUP BY world_id;", auditWorldReset, auditSnapshotRestore)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer epochRows.Close()
+	for epochRows.Next() {
+		var world string
+		var epoch int
+		if err := epochRows.Scan(&world, &epoch); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		epochs[world] = epoch
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"entries": entries, "epochs": epochs})
+}
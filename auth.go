@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/auth"
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/api/option"
+)
+
+// context key of the user id set by authenticate and read by every handler
+const userKey = "uid"
+
+// checks the token sent in the Authorization header and returns the account's uid, which the Firebase table maps to a user
+type AuthProvider interface {
+	Verify(ctx context.Context, token string) (string, error)
+}
+
+// providers that hold accounts themselves, signup creates the account there first
+type accountProvider interface {
+	AuthProvider
+	Account(ctx context.Context, email string, password string, name string, phone string) (string, error)
+}
+
+// auth.provider selects firebase (the default) or jwt
+func newAuthProvider() (AuthProvider, error) {
+	switch settings.Auth.Provider {
+	case "", "firebase":
+		return newFirebaseProvider()
+	case "jwt":
+		return newJWTProvider()
+	default:
+		return nil, errors.New("auth.provider must be firebase or jwt")
+	}
+}
+
+type firebaseProvider struct {
+	client *auth.Client
+}
+
+func newFirebaseProvider() (*firebaseProvider, error) {
+	options := option.WithCredentialsFile(settings.Auth.FirebaseCredentials)
+	fb, err := firebase.NewApp(context.Background(), nil, options)
+	if err != nil {
+		return nil, errors.New("firebase connection failed")
+	}
+	fba, err := fb.Auth(context.Background())
+	if err != nil {
+		return nil, errors.New("firebase auth failed")
+	}
+	return &firebaseProvider{client: fba}, nil
+}
+
+// Firebase calls go through firebaseBreaker, invalid tokens do not count as failures
+func (p *firebaseProvider) call(f func() error) error {
+	if !firebaseBreaker.allow() {
+		return errCircuitOpen
+	}
+	err := f()
+	if dependencyFailed(err) {
+		firebaseBreaker.record(err)
+	} else {
+		firebaseBreaker.record(nil)
+	}
+	return err
+}
+
+func (p *firebaseProvider) Verify(ctx context.Context, token string) (string, error) {
+	var uid string
+	err := p.call(func() error {
+		verified, err := p.client.VerifyIDToken(ctx, token)
+		if err == nil {
+			uid = verified.UID
+		}
+		return err
+	})
+	return uid, err
+}
+
+// looks up an account that does not exist, a not found answer means the Auth API is reachable
+func (p *firebaseProvider) Ping(ctx context.Context) error {
+	return p.call(func() error {
+		_, err := p.client.GetUser(ctx, "readiness-probe")
+		if auth.IsUserNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// reuses the Firebase account registered with the email if there is one
+func (p *firebaseProvider) Account(ctx context.Context, email string, password string, name string, phone string) (string, error) {
+	var existing *auth.UserRecord
+	if err := p.call(func() (err error) {
+		existing, err = p.client.GetUserByEmail(ctx, email)
+		if auth.IsUserNotFound(err) {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if existing != nil && existing.UserInfo != nil {
+		return existing.UserInfo.UID, nil
+	}
+	params := (&auth.UserToCreate{}).
+		Email(email).
+		EmailVerified(false).
+		Password(password).
+		DisplayName(name).
+		Disabled(false)
+	if phone != "" {
+		params = params.PhoneNumber(phone)
+	}
+	var uid string
+	err := p.call(func() error {
+		user, err := p.client.CreateUser(ctx, params)
+		if err == nil {
+			uid = user.UID
+		}
+		return err
+	})
+	return uid, err
+}
+
+// locally signed tokens whose subject is the uid, for development and tests.
+// HS256 uses JWT_SECRET, RS256 verifies with the PEM key in JWT_PUBLIC_KEY and signs with JWT_PRIVATE_KEY.
+// JWT_ISSUER, if set, is required in every token
+type jwtProvider struct {
+	method  jwt.SigningMethod
+	verify  any
+	sign    any
+	issuer  string
+	parser  *jwt.Parser
+	signErr error
+}
+
+func newJWTProvider() (*jwtProvider, error) {
+	p := &jwtProvider{issuer: settings.Auth.JWTIssuer}
+	switch settings.Auth.JWTAlg {
+	case "", "HS256":
+		secret := settings.Auth.JWTSecret
+		if len(secret) < 32 {
+			return nil, errors.New("JWT_SECRET must be at least 32 characters for HS256")
+		}
+		p.method, p.verify, p.sign = jwt.SigningMethodHS256, []byte(secret), []byte(secret)
+	case "RS256":
+		p.method = jwt.SigningMethodRS256
+		buf, err := os.ReadFile(settings.Auth.JWTPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEY: %w", err)
+		}
+		if p.verify, err = jwt.ParseRSAPublicKeyFromPEM(buf); err != nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEY: %w", err)
+		}
+		//the server only verifies, the private key is needed to mint tokens
+		if buf, err := os.ReadFile(settings.Auth.JWTPrivateKey); err != nil {
+			p.signErr = fmt.Errorf("JWT_PRIVATE_KEY: %w", err)
+		} else if p.sign, err = jwt.ParseRSAPrivateKeyFromPEM(buf); err != nil {
+			p.signErr = fmt.Errorf("JWT_PRIVATE_KEY: %w", err)
+		}
+	default:
+		return nil, errors.New("JWT_ALG must be HS256 or RS256")
+	}
+	p.parser = jwt.NewParser(jwt.WithValidMethods([]string{p.method.Alg()}))
+	return p, nil
+}
+
+func (p *jwtProvider) Verify(ctx context.Context, token string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	if _, err := p.parser.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) { return p.verify, nil }); err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	if claims.ExpiresAt == nil {
+		return "", errors.New("token has no expiry")
+	}
+	if p.issuer != "" && !claims.VerifyIssuer(p.issuer, true) {
+		return "", errors.New("token has the wrong issuer")
+	}
+	return claims.Subject, nil
+}
+
+func (p *jwtProvider) mint(uid string, ttl time.Duration) (string, error) {
+	if p.signErr != nil {
+		return "", p.signErr
+	}
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   uid,
+		Issuer:    p.issuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	return jwt.NewWithClaims(p.method, claims).SignedString(p.sign)
+}
+
+// token -uid <uid> [-ttl 24h], prints a token for the jwt provider
+func tokenCommand(args []string) error {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	uid := flags.String("uid", "", "account uid, the subject of the token")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the token is valid")
+	flags.Parse(args)
+	if *uid == "" || *ttl <= 0 {
+		return errors.New("usage: token -uid <uid> [-ttl 24h]")
+	}
+	p, err := newJWTProvider()
+	if err != nil {
+		return err
+	}
+	token, err := p.mint(*uid, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
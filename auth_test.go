@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example/ecommsimapis/config"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// provider built from auth settings changed by change, the settings are restored after the test
+func jwtProviderWith(t *testing.T, change func(auth *config.Auth)) (*jwtProvider, error) {
+	t.Helper()
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.Auth = config.Auth{Provider: "jwt", JWTAlg: "HS256", JWTSecret: testSecret}
+	change(&settings.Auth)
+	return newJWTProvider()
+}
+
+// writes a new RSA key pair as PEM files
+func rsaKeys(t *testing.T) (public string, private string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	public, private = filepath.Join(dir, "public.pem"), filepath.Join(dir, "private.pem")
+	os.WriteFile(public, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	os.WriteFile(private, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600)
+	return public, private
+}
+
+func TestJWTProviderSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(auth *config.Auth)
+		want   string
+	}{
+		{"hs256", func(auth *config.Auth) {}, ""},
+		{"default algorithm", func(auth *config.Auth) { auth.JWTAlg = "" }, ""},
+		{"short secret", func(auth *config.Auth) { auth.JWTSecret = "short" }, "at least 32 characters"},
+		{"unknown algorithm", func(auth *config.Auth) { auth.JWTAlg = "none" }, "HS256 or RS256"},
+		{"missing public key", func(auth *config.Auth) { auth.JWTAlg, auth.JWTPublicKey = "RS256", "missing.pem" }, "JWT_PUBLIC_KEY"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := jwtProviderWith(t, test.change)
+			if test.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestJWTProviderVerify(t *testing.T) {
+	p, err := jwtProviderWith(t, func(auth *config.Auth) { auth.JWTIssuer = "ecommsim" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, key any, claims jwt.RegisteredClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := func() jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{Subject: "uid-1", Issuer: "ecommsim", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	}
+	minted, err := p.mint("uid-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := p.mint("uid-1", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSubject, noExpiry, otherIssuer := valid(), valid(), valid()
+	noSubject.Subject = ""
+	noExpiry.ExpiresAt = nil
+	otherIssuer.Issuer = "elsewhere"
+	_, private := rsaKeys(t)
+	buf, _ := os.ReadFile(private)
+	rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"minted", minted, true},
+		{"signed elsewhere with the secret", sign(jwt.SigningMethodHS256, []byte(testSecret), valid()), true},
+		{"expired", expired, false},
+		{"wrong secret", sign(jwt.SigningMethodHS256, []byte(strings.Repeat("x", 32)), valid()), false},
+		{"no subject", sign(jwt.SigningMethodHS256, []byte(testSecret), noSubject), false},
+		{"no expiry", sign(jwt.SigningMethodHS256, []byte(testSecret), noExpiry), false},
+		{"other issuer", sign(jwt.SigningMethodHS256, []byte(testSecret), otherIssuer), false},
+		{"other algorithm", sign(jwt.SigningMethodRS256, rsaKey, valid()), false},
+		{"unsigned", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid()), false},
+		{"garbage", "not.a.token", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uid, err := p.Verify(context.Background(), test.token)
+			if test.ok && (err != nil || uid != "uid-1") {
+				t.Fatalf("got %q %v, want uid-1", uid, err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("accepted as %q", uid)
+			}
+		})
+	}
+}
+
+func TestJWTProviderRS256(t *testing.T) {
+	public, private := rsaKeys(t)
+	p, err := jwtProviderWith(t, func(auth *config.Auth) {
+		auth.JWTAlg, auth.JWTPublicKey, auth.JWTPrivateKey = "RS256", public, private
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := p.mint("uid-2", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, err := p.Verify(context.Background(), token); err != nil || uid != "uid-2" {
+		t.Fatalf("got %q %v, want uid-2", uid, err)
+	}
+
+	//without the private key the server still verifies but cannot mint
+	verifier, err := jwtProviderWith(t, func(auth *config.Auth) { auth.JWTAlg, auth.JWTPublicKey = "RS256", public })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, err := verifier.Verify(context.Background(), token); err != nil || uid != "uid-2" {
+		t.Fatalf("got %q %v, want uid-2", uid, err)
+	}
+	if _, err := verifier.mint("uid-2", time.Hour); err == nil || !strings.Contains(err.Error(), "JWT_PRIVATE_KEY") {
+		t.Fatalf("got %v, want a private key error", err)
+	}
+}
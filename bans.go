@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+type ban struct {
+	Id        string `json:"id"`
+	Reason    string `json:"reason"`
+	Moderator string `json:"moderator,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Expires   string `json:"expires,omitempty"`
+	Lifted    string `json:"lifted,omitempty"`
+	LiftedBy  string `json:"liftedBy,omitempty"`
+}
+
+// bans the user unless they already have an active ban, expires is zero for permanent bans
+func banUser(ctx context.Context, db *sql.DB, rdb *redis.Client, user string, moderator string, reason string, expires time.Time) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	//locks the user so two moderators cannot ban at once
+	var world, status string
+	if err := tx.QueryRowContext(ctx, "SELECT world_id, status FROM Users WHERE id = $1 FOR UPDATE;", user).Scan(&world, &status); err != nil {
+		return false, err
+	}
+	var active bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM Bans WHERE user_id = $1 AND lifted IS NULL);", user).Scan(&active); err != nil || active {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO Bans(user_id, moderator_id, reason, created, expires) VALUES($1, $2, $3, $4, $5);",
+		user, nullable(moderator), reason, clock.Now(), sql.NullTime{Time: expires, Valid: !expires.IsZero()}); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE Users SET status = 'B' WHERE id = $1;", user); err != nil {
+		return false, err
+	}
+	after := map[string]any{"status": "B", "reason": reason}
+	if !expires.IsZero() {
+		after["expires"] = expires
+	}
+	if err := audit(ctx, tx, world, moderator, auditBan, "user", user, map[string]any{"status": status}, after); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	//the user's listings leave the searches of their world
+	statusCache.Delete(ctx, rdb, user)
+	searchCache.Invalidate(ctx, rdb, world)
+	return true, nil
+}
+
+// lifts the user's active ban, moderator is empty when the ban expired
+func liftBan(ctx context.Context, db *sql.DB, rdb *redis.Client, user string, moderator string, at time.Time) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var ban string
+	err = tx.QueryRowContext(ctx, "UPDATE Bans SET lifted = $1, lifted_by = $2 WHERE user_id = $3 AND lifted IS NULL RETURNING id;",
+		at, nullable(moderator), user).Scan(&ban)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var world string
+	if err := tx.QueryRowContext(ctx, "UPDATE Users SET status = 'A' WHERE id = $1 RETURNING world_id;", user).Scan(&world); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE BanAppeals SET status = 'closed', resolved = $1 WHERE user_id = $2 AND status = 'open';",
+		at, user); err != nil {
+		return false, err
+	}
+	if err := audit(ctx, tx, world, moderator, auditUnban, "user", user, map[string]any{"status": "B", "ban": ban}, map[string]any{"status": "A"}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	statusCache.Delete(ctx, rdb, user)
+	searchCache.Invalidate(ctx, rdb, world)
+	return true, nil
+}
+
+// lifts expired bans every jobs.banInterval (a minute by default) until ctx is cancelled
+func runBanExpiry(ctx context.Context, db *sql.DB, rdb *redis.Client) {
+	ticker := time.NewTicker(settings.Jobs.BanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := expireBans(ctx, db, rdb); err != nil {
+				log.Printf("ban expiry failed: %v", err)
+			}
+		}
+	}
+}
+
+func expireBans(ctx context.Context, db *sql.DB, rdb *redis.Client) error {
+	rows, err := db.QueryContext(ctx, "SELECT user_id, expires FROM Bans WHERE lifted IS NULL AND expires <= $1;", clock.Now())
+	if err != nil {
+		return err
+	}
+	expired := map[string]time.Time{}
+	for rows.Next() {
+		var user string
+		var expires time.Time
+		if err := rows.Scan(&user, &expires); err != nil {
+			rows.Close()
+			return err
+		}
+		expired[user] = expires
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for user, expires := range expired {
+		if _, err := liftBan(ctx, db, rdb, user, "", expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// every ban of the user, newest first
+func userBansGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	id, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var bans []ban
+	rows, err := db.Query("SELECT Bans.id, reason, COALESCE(moderator_id::text, ''), Bans.created, COALESCE(expires::text, ''),"+
+		" COALESCE(lifted::text, ''), COALESCE(lifted_by::text, '') FROM Bans JOIN Users ON Users.id = Bans.user_id"+
+		" WHERE Bans.user_id::text = $1 AND Users.world_id = $2 ORDER BY Bans.created DESC, Bans.id DESC"+
+		" LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", id, worldOf(c))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b ban
+		if err := rows.Scan(&b.Id, &b.Reason, &b.Moderator, &b.Timestamp, &b.Expires, &b.Lifted, &b.LiftedBy); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		bans = append(bans, b)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"bans": bans})
+}
+
+// the banned user's appeal against their active ban, one open appeal per ban
+func appealPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	var appeal struct {
+		Text string `json:"text" binding:"required,max=2000"`
+	}
+	if err := c.BindJSON(&appeal); err != nil {
+		return
+	}
+	var banId string
+	if err := db.QueryRow("SELECT id FROM Bans WHERE user_id = $1 AND lifted IS NULL;", uid.(string)).Scan(&banId); err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	var id string
+	err := db.QueryRow("INSERT INTO BanAppeals(ban_id, user_id, text, status, created) SELECT $1, $2, $3, 'open', $4"+
+		" WHERE NOT EXISTS(SELECT 1 FROM BanAppeals WHERE ban_id = $1 AND status = 'open') RETURNING id;",
+		banId, uid.(string), appeal.Text, clock.Now()).Scan(&id)
+	if err == sql.ErrNoRows {
+		fail(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"id": id})
+}
+
+// appeals in the world, open ones by default
+func appealsGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	status := c.DefaultQuery("status", "open")
+	if status != "open" && status != "accepted" && status != "rejected" && status != "closed" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var appeals []struct {
+		Id        string `json:"id"`
+		User      string `json:"user"`
+		Ban       ban    `json:"ban"`
+		Text      string `json:"text"`
+		Status    string `json:"status"`
+		Response  string `json:"response,omitempty"`
+		Timestamp string `json:"timestamp"`
+	}
+	rows, err := db.Query("SELECT BanAppeals.id, BanAppeals.user_id, BanAppeals.text, BanAppeals.status, COALESCE(BanAppeals.response, ''),"+
+		" BanAppeals.created, Bans.id, Bans.reason, COALESCE(Bans.moderator_id::text, ''), Bans.created, COALESCE(Bans.expires::text, '')"+
+		" FROM BanAppeals JOIN Bans ON Bans.id = BanAppeals.ban_id JOIN Users ON Users.id = BanAppeals.user_id"+
+		" WHERE BanAppeals.status = $1 AND Users.world_id = $2 ORDER BY BanAppeals.created"+
+		" LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", status, worldOf(c))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var appeal struct {
+			Id        string `json:"id"`
+			User      string `json:"user"`
+			Ban       ban    `json:"ban"`
+			Text      string `json:"text"`
+			Status    string `json:"status"`
+			Response  string `json:"response,omitempty"`
+			Timestamp string `json:"timestamp"`
+		}
+		if err := rows.Scan(&appeal.Id, &appeal.User, &appeal.Text, &appeal.Status, &appeal.Response, &appeal.Timestamp,
+			&appeal.Ban.Id, &appeal.Ban.Reason, &appeal.Ban.Moderator, &appeal.Ban.Timestamp, &appeal.Ban.Expires); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		appeals = append(appeals, appeal)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"appeals": appeals})
+}
+
+// accepting an appeal lifts the ban
+func appealPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	moderator, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	id, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var decision struct {
+		Accept   *bool  `json:"accept" binding:"required"`
+		Response string `json:"response"`
+	}
+	if err := c.BindJSON(&decision); err != nil {
+		return
+	}
+	status, action := "rejected", auditAppealReject
+	if *decision.Accept {
+		status, action = "accepted", auditAppealAccept
+	}
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	var user string
+	err = tx.QueryRow("UPDATE BanAppeals SET status = $1, response = $2, resolved = $3, resolver_id = $4 FROM Users"+
+		" WHERE BanAppeals.id::text = $5 AND BanAppeals.status = 'open' AND Users.id = BanAppeals.user_id AND Users.world_id = $6"+
+		" RETURNING BanAppeals.user_id;", status, nullable(decision.Response), clock.Now(), moderator.(string), id, worldOf(c)).Scan(&user)
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if err := audit(c.Request.Context(), tx, worldOf(c), moderator.(string), action, "appeal", id, map[string]any{"status": "open"},
+		map[string]any{"status": status, "response": decision.Response}); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if *decision.Accept {
+		if _, err := liftBan(c.Request.Context(), db, rdb, user, moderator.(string), clock.Now()); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.Status(http.StatusOK)
+}
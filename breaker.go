@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// returned instead of calling a dependency whose breaker is open
+var errCircuitOpen = errors.New("circuit open")
+
+// breakers of the dependencies the server can run without for a while
+var (
+	redisBreaker    = newBreaker("redis", 5, 10*time.Second)
+	firebaseBreaker = newBreaker("firebase", 5, 30*time.Second)
+)
+
+// stops calling a dependency for cooldown after threshold consecutive failures, then lets a single call through to probe it
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// err is nil or a failure of the dependency itself, errors about the request do not count
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.failures >= b.threshold {
+			log.Printf("%s circuit closed", b.name)
+		}
+		b.failures, b.probing = 0, false
+		return
+	}
+	b.failures++
+	if b.failures == b.threshold || b.probing {
+		log.Printf("%s circuit open for %s: %v", b.name, b.cooldown, err)
+	}
+	if b.failures >= b.threshold {
+		b.openUntil, b.probing = time.Now().Add(b.cooldown), false
+	}
+}
+
+// closed, open or half-open while a probe is running
+func (b *breaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return "closed"
+	case b.probing:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// network failures and timeouts, the errors that say the dependency is down
+func dependencyFailed(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// routes every Redis command through the breaker, replies such as redis.Nil or WRONGTYPE are not failures
+type breakerHook struct {
+	b *breaker
+}
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !h.b.allow() {
+			cmd.SetErr(errCircuitOpen)
+			return errCircuitOpen
+		}
+		err := next(ctx, cmd)
+		h.b.record(redisFailure(err))
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !h.b.allow() {
+			for _, cmd := range cmds {
+				cmd.SetErr(errCircuitOpen)
+			}
+			return errCircuitOpen
+		}
+		err := next(ctx, cmds)
+		h.b.record(redisFailure(err))
+		return err
+	}
+}
+
+func redisFailure(err error) error {
+	var reply redis.Error
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled) || errors.As(err, &reply) {
+		return nil
+	}
+	return err
+}
+
+// retries check stores.startupRetries times (5 by default), doubling the wait from one second, so the server can start alongside its stores
+func waitFor(name string, check func(ctx context.Context) error) error {
+	retries := settings.Stores.StartupRetries
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := check(ctx)
+		cancel()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		log.Printf("%s unreachable, retrying in %s: %v", name, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// answers 503 with Retry-After when err comes from an open breaker, so clients back off instead of seeing a 500
+func unavailable(c *gin.Context, b *breaker, err error) bool {
+	if !errors.Is(err, errCircuitOpen) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(b.cooldown.Seconds())))
+	fail(c, http.StatusServiceUnavailable, err)
+	return true
+}
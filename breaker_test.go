@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// a reply from Redis such as WRONGTYPE
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (e replyError) RedisError()   {}
+
+func TestBreaker(t *testing.T) {
+	down := errors.New("connection refused")
+	//f records a failure, s a success, e ends the cooldown, + and - expect allow to be true or false
+	tests := []struct {
+		name  string
+		steps string
+		state string
+	}{
+		{"closed below threshold", "ff+", "closed"},
+		{"opens at threshold", "fff-", "open"},
+		{"success resets failures", "ffsff+", "closed"},
+		{"stays open during cooldown", "fff--", "open"},
+		{"single probe after cooldown", "fffe+-", "half-open"},
+		{"probe success closes", "fffe+s++", "closed"},
+		{"probe failure reopens", "fffe+f-", "open"},
+		{"probe again after second cooldown", "fffe+fe+", "half-open"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBreaker("test", 3, time.Hour)
+			for i, step := range test.steps {
+				switch step {
+				case 'f':
+					b.record(down)
+				case 's':
+					b.record(nil)
+				case 'e':
+					b.openUntil = time.Now().Add(-time.Second)
+				case '+', '-':
+					if got := b.allow(); got != (step == '+') {
+						t.Fatalf("step %d of %q: allow() = %v", i, test.steps, got)
+					}
+				}
+			}
+			if got := b.state(); got != test.state {
+				t.Fatalf("state %q, want %q", got, test.state)
+			}
+		})
+	}
+}
+
+func TestRedisFailure(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name   string
+		err    error
+		counts bool
+	}{
+		{"success", nil, false},
+		{"missing key", redis.Nil, false},
+		{"cancelled request", context.Canceled, false},
+		{"reply error", replyError("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{"wrapped reply error", fmt.Errorf("trending: %w", replyError("ERR syntax error")), false},
+		{"network error", refused, true},
+		{"timeout", context.DeadlineExceeded, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := redisFailure(test.err) != nil; got != test.counts {
+				t.Fatalf("redisFailure(%v) counts = %v, want %v", test.err, got, test.counts)
+			}
+		})
+	}
+}
+
+func TestDependencyFailed(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, true},
+		{"wrapped timeout", fmt.Errorf("verify: %w", context.DeadlineExceeded), true},
+		{"invalid token", errors.New("token has expired"), false},
+		{"no error", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := dependencyFailed(test.err); got != test.want {
+				t.Fatalf("dependencyFailed(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
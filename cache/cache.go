@@ -0,0 +1,144 @@
+// values cached in Redis as JSON under cache:<namespace>:<key>, every namespace with its own TTL
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// matches every cached value, for flushing the cache when the database is replaced
+const Pattern = "cache:*"
+
+// Fetch results per namespace since the process started
+type Stats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	Stale   int64   `json:"stale"`
+	HitRate float64 `json:"hitRate"`
+}
+
+type counters struct {
+	hits, misses, stale atomic.Int64
+}
+
+var stats sync.Map
+
+func countersOf(name string) *counters {
+	c, _ := stats.LoadOrStore(name, &counters{})
+	return c.(*counters)
+}
+
+// stats of every namespace Fetch was called on, stale copies count as hits
+func Snapshot() map[string]Stats {
+	all := map[string]Stats{}
+	stats.Range(func(name, value any) bool {
+		c := value.(*counters)
+		s := Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Stale: c.stale.Load()}
+		if total := s.Hits + s.Stale + s.Misses; total > 0 {
+			s.HitRate = float64(s.Hits+s.Stale) / float64(total)
+		}
+		all[name.(string)] = s
+		return true
+	})
+	return all
+}
+
+type Namespace struct {
+	name  string
+	ttl   time.Duration
+	stale time.Duration
+}
+
+func New(name string, ttl time.Duration) Namespace {
+	return Namespace{name: name, ttl: ttl}
+}
+
+// keeps a copy of every value for d, which Fetch serves when loading fails, e.g. while the database is down
+func (n Namespace) WithStale(d time.Duration) Namespace {
+	n.stale = d
+	return n
+}
+
+func (n Namespace) Key(key string) string {
+	return "cache:" + n.name + ":" + key
+}
+
+// false if the key is not cached, Redis errors count as misses so callers fall back to the database
+func (n Namespace) Get(ctx context.Context, rdb redis.Cmdable, key string, value any) bool {
+	buf, err := rdb.Get(ctx, n.Key(key)).Bytes()
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(buf, value) == nil
+}
+
+func (n Namespace) Set(ctx context.Context, rdb redis.Cmdable, key string, value any) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if n.stale > 0 {
+		rdb.Set(ctx, n.Key("stale:"+key), buf, n.stale)
+	}
+	return rdb.Set(ctx, n.Key(key), buf, n.ttl).Err()
+}
+
+func (n Namespace) Delete(ctx context.Context, rdb redis.Cmdable, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	full := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		full = append(full, n.Key(key), n.Key("stale:"+key))
+	}
+	return rdb.Del(ctx, full...).Err()
+}
+
+// generation of a group of keys, include it in the keys of the group so Invalidate drops all of them at once
+func (n Namespace) Version(ctx context.Context, rdb redis.Cmdable, group string) string {
+	version, err := rdb.Get(ctx, n.Key("version:"+group)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "0"
+	}
+	if err != nil {
+		//an unknown version never matches a cached key
+		return "miss:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return version
+}
+
+// starts a new generation of the group, the keys of older generations expire with their TTL
+func (n Namespace) Invalidate(ctx context.Context, rdb redis.Cmdable, group string) error {
+	return rdb.Incr(ctx, n.Key("version:"+group)).Err()
+}
+
+// read-through: the cached value or the loaded one, which is cached unless loading fails.
+// when loading fails the stale copy is served if the namespace keeps one
+func Fetch[T any](ctx context.Context, rdb redis.Cmdable, n Namespace, key string, load func() (T, error)) (T, error) {
+	counts := countersOf(n.name)
+	var value T
+	if n.Get(ctx, rdb, key, &value) {
+		counts.hits.Add(1)
+		return value, nil
+	}
+	value, err := load()
+	if err != nil {
+		var stale T
+		if n.stale > 0 && n.Get(ctx, rdb, "stale:"+key, &stale) {
+			counts.stale.Add(1)
+			return stale, nil
+		}
+		counts.misses.Add(1)
+		return value, err
+	}
+	counts.misses.Add(1)
+	n.Set(ctx, rdb, key, value)
+	return value, nil
+}
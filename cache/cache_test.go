@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// in-memory stand-in for the commands the cache uses, every command fails while down is set
+type fakeRedis struct {
+	redis.Cmdable
+	values map[string]string
+	down   bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: map[string]string{}}
+}
+
+var errDown = errors.New("connection refused")
+
+func (r *fakeRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	if r.down {
+		return redis.NewStringResult("", errDown)
+	}
+	value, ok := r.values[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(value, nil)
+}
+
+func (r *fakeRedis) Set(ctx context.Context, key string, value any, expiration time.Duration) *redis.StatusCmd {
+	if r.down {
+		return redis.NewStatusResult("", errDown)
+	}
+	r.values[key] = string(value.([]byte))
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (r *fakeRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	if r.down {
+		return redis.NewIntResult(0, errDown)
+	}
+	var n int64
+	for _, key := range keys {
+		if _, ok := r.values[key]; ok {
+			delete(r.values, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (r *fakeRedis) Incr(ctx context.Context, key string) *redis.IntCmd {
+	if r.down {
+		return redis.NewIntResult(0, errDown)
+	}
+	n, _ := strconv.ParseInt(r.values[key], 10, 64)
+	r.values[key] = strconv.FormatInt(n+1, 10)
+	return redis.NewIntResult(n+1, nil)
+}
+
+// load that counts its calls and returns value, or err when set
+type loader struct {
+	calls int
+	value string
+	err   error
+}
+
+func (l *loader) load() (string, error) {
+	l.calls++
+	return l.value, l.err
+}
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	rdb := newFakeRedis()
+	n := New("fetch", time.Minute)
+	l := &loader{value: "ann"}
+
+	for i := 0; i < 3; i++ {
+		value, err := Fetch(ctx, rdb, n, "1", l.load)
+		if err != nil || value != "ann" {
+			t.Fatalf("fetch %d: got %q %v, want ann", i, value, err)
+		}
+	}
+	if l.calls != 1 {
+		t.Fatalf("loaded %d times, want once", l.calls)
+	}
+	if got := Snapshot()["fetch"]; got.Hits != 2 || got.Misses != 1 {
+		t.Fatalf("got %+v, want 2 hits and a miss", got)
+	}
+
+	//Redis errors fall back to loading
+	rdb.down = true
+	if value, err := Fetch(ctx, rdb, n, "1", l.load); err != nil || value != "ann" || l.calls != 2 {
+		t.Fatalf("got %q %v after %d loads, want ann loaded again", value, err, l.calls)
+	}
+}
+
+func TestFetchLoadError(t *testing.T) {
+	ctx := context.Background()
+	rdb := newFakeRedis()
+	failing := &loader{err: errors.New("database down")}
+	tests := []struct {
+		name  string
+		n     Namespace
+		want  string
+		stale bool
+	}{
+		{"without a stale copy", New("plain", time.Minute), "", false},
+		{"with a stale copy", New("stale", time.Minute).WithStale(time.Hour), "ann", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Fetch(ctx, rdb, test.n, "1", (&loader{value: "ann"}).load); err != nil {
+				t.Fatal(err)
+			}
+			//the fresh copy expires, the stale one outlives it
+			delete(rdb.values, test.n.Key("1"))
+			value, err := Fetch(ctx, rdb, test.n, "1", failing.load)
+			if value != test.want || (err == nil) != test.stale {
+				t.Fatalf("got %q %v, want %q", value, err, test.want)
+			}
+			if _, cached := rdb.values[test.n.Key("1")]; cached {
+				t.Fatal("failed load was cached")
+			}
+		})
+	}
+	if got := Snapshot()["stale"]; got.Stale != 1 {
+		t.Fatalf("got %+v, want a stale read", got)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	rdb := newFakeRedis()
+	n := New("delete", time.Minute).WithStale(time.Hour)
+	n.Set(ctx, rdb, "1", "ann")
+	n.Set(ctx, rdb, "2", "bob")
+	if len(rdb.values) != 4 {
+		t.Fatalf("got %v, want each value with a stale copy", rdb.values)
+	}
+	n.Delete(ctx, rdb, "1")
+	var value string
+	if n.Get(ctx, rdb, "1", &value) || n.Get(ctx, rdb, "stale:1", &value) {
+		t.Fatal("deleted value still cached")
+	}
+	if !n.Get(ctx, rdb, "2", &value) || value != "bob" {
+		t.Fatalf("got %q, want the other value kept", value)
+	}
+}
+
+func TestVersionInvalidate(t *testing.T) {
+	ctx := context.Background()
+	rdb := newFakeRedis()
+	n := New("search", time.Minute)
+	key := func(group string) string { return group + ":" + n.Version(ctx, rdb, group) + ":query" }
+
+	first := key("1")
+	if first != "1:0:query" {
+		t.Fatalf("got %q, want version 0 before any invalidation", first)
+	}
+	n.Set(ctx, rdb, first, "results")
+	n.Set(ctx, rdb, key("2"), "results")
+	if err := n.Invalidate(ctx, rdb, "1"); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if second := key("1"); second == first || n.Get(ctx, rdb, second, &value) {
+		t.Fatalf("key %q still cached after invalidation", second)
+	}
+	if !n.Get(ctx, rdb, key("2"), &value) {
+		t.Fatal("invalidating a group dropped another one")
+	}
+
+	//an unknown version matches nothing, not even itself
+	rdb.down = true
+	if a, b := n.Version(ctx, rdb, "1"), n.Version(ctx, rdb, "1"); a == b || !strings.HasPrefix(a, "miss:") {
+		t.Fatalf("got versions %q and %q while Redis is down", a, b)
+	}
+}
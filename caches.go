@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"example/ecommsimapis/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// values cached in Redis, the short TTLs bound how stale a value missed by invalidation can get
+var (
+	//world:uid → user id, set by authenticate
+	uidCache = cache.New("uid", 24*time.Hour)
+	//user id → status, set by checkStatus and dropped by bans
+	statusCache = cache.New("status", 10*time.Minute)
+	//user id → permissions, dropped by role changes
+	permissionCache = cache.New("permissions", 10*time.Minute)
+	//profiles, listings and searches are served stale while Postgres is unreachable
+	userCache    = cache.New("user", 5*time.Minute).WithStale(24 * time.Hour)
+	productCache = cache.New("product", 5*time.Minute).WithStale(24 * time.Hour)
+	//results per world and query, all searches of a world are dropped together
+	searchCache = cache.New("search", time.Minute).WithStale(time.Hour)
+)
+
+// drops the cached products and every cached search of the world
+func invalidateProducts(ctx context.Context, rdb *redis.Client, world string, products ...string) {
+	productCache.Delete(ctx, rdb, products...)
+	searchCache.Invalidate(ctx, rdb, world)
+}
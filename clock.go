@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	clockReal        = "real"
+	clockAccelerated = "accelerated"
+	clockFrozen      = "frozen"
+)
+
+// simulation time, runs at real speed, N simulated minutes per real second, or stands still until stepped
+type simClock struct {
+	mu       sync.Mutex
+	mode     string
+	rate     float64 //simulated minutes per real second in accelerated mode
+	realBase time.Time
+	simBase  time.Time
+}
+
+// shared by the whole process, real until loadSettings applies clock.mode and clock.rate
+var clock = newSimClock()
+
+func newSimClock() *simClock {
+	now := time.Now()
+	return &simClock{mode: clockReal, rate: 1, realBase: now, simBase: now}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now(time.Now())
+}
+
+func (c *simClock) now(real time.Time) time.Time {
+	elapsed := real.Sub(c.realBase)
+	switch c.mode {
+	case clockAccelerated:
+		return c.simBase.Add(time.Duration(float64(elapsed) * c.rate * 60))
+	case clockFrozen:
+		return c.simBase
+	default:
+		return c.simBase.Add(elapsed)
+	}
+}
+
+// switches mode keeping the current simulated time, unknown modes are ignored
+func (c *simClock) set(mode string, rate float64) bool {
+	if mode != clockReal && mode != clockAccelerated && mode != clockFrozen {
+		return false
+	}
+	real := time.Now()
+	c.simBase = c.now(real)
+	c.realBase = real
+	c.mode = mode
+	if mode == clockAccelerated {
+		c.rate = rate
+	}
+	return true
+}
+
+func (c *simClock) Set(mode string, rate float64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.set(mode, rate)
+}
+
+// moves simulated time forward by d in any mode
+func (c *simClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.simBase = c.simBase.Add(d)
+	return c.now(time.Now())
+}
+
+func (c *simClock) Mode() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mode
+}
+
+func (c *simClock) status() gin.H {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return gin.H{"now": c.now(time.Now()), "mode": c.mode, "rate": c.rate}
+}
+
+func clockGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	c.IndentedJSON(http.StatusOK, clock.status())
+}
+
+func clockPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var mode struct {
+		Mode string  `json:"mode" binding:"required,oneof=real accelerated frozen"`
+		Rate float64 `json:"rate" binding:"required_if=Mode accelerated,gte=0"`
+	}
+	if err := c.BindJSON(&mode); err != nil {
+		return
+	}
+	before := clock.status()
+	clock.Set(mode.Mode, mode.Rate)
+	if err := audit(c.Request.Context(), db, defaultWorld, c.GetString(userKey), auditClockSet, "clock", "clock", before, clock.status()); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, clock.status())
+}
+
+func clockAdvancePost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var step struct {
+		Duration string `json:"duration" binding:"required"`
+	}
+	if err := c.BindJSON(&step); err != nil {
+		return
+	}
+	d, err := time.ParseDuration(step.Duration)
+	if err != nil || d <= 0 {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	before := clock.status()
+	clock.Advance(d)
+	if err := audit(c.Request.Context(), db, defaultWorld, c.GetString(userKey), auditClockAdvance, "clock", "clock", before, clock.status()); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, clock.status())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSimClockNow(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		mode    string
+		rate    float64
+		elapsed time.Duration //real time since the base
+		want    time.Time
+	}{
+		{clockReal, 1, 10 * time.Second, base.Add(10 * time.Second)},
+		{clockAccelerated, 1, 10 * time.Second, base.Add(10 * time.Minute)},
+		{clockAccelerated, 30, 2 * time.Second, base.Add(time.Hour)},
+		{clockFrozen, 1, time.Hour, base},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s at %v", test.mode, test.rate), func(t *testing.T) {
+			c := &simClock{mode: test.mode, rate: test.rate, realBase: base, simBase: base}
+			if got := c.now(base.Add(test.elapsed)); !got.Equal(test.want) {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSimClockSet(t *testing.T) {
+	c := newSimClock()
+	if c.Set("sideways", 5) {
+		t.Fatal("unknown mode accepted")
+	}
+	if c.mode != clockReal {
+		t.Fatalf("unknown mode changed the clock to %s", c.mode)
+	}
+
+	//switching keeps the simulated time where it was
+	if !c.Set(clockFrozen, 0) {
+		t.Fatal("frozen rejected")
+	}
+	frozen := c.Now()
+	time.Sleep(5 * time.Millisecond)
+	if !c.Now().Equal(frozen) {
+		t.Fatal("frozen clock moved")
+	}
+	c.Set(clockAccelerated, 60)
+	if got := c.Now(); got.Before(frozen) || got.Sub(frozen) > time.Minute {
+		t.Fatalf("switching jumped from %s to %s", frozen, got)
+	}
+	if c.rate != 60 {
+		t.Fatalf("rate %v", c.rate)
+	}
+
+	//the rate only changes when accelerating
+	c.Set(clockReal, 5)
+	if c.rate != 60 {
+		t.Fatalf("real mode changed the rate to %v", c.rate)
+	}
+}
+
+func TestSimClockAdvance(t *testing.T) {
+	c := newSimClock()
+	c.Set(clockFrozen, 0)
+	start := c.Now()
+	if got := c.Advance(36 * time.Hour); !got.Equal(start.Add(36 * time.Hour)) {
+		t.Fatalf("advanced to %s, want %s", got, start.Add(36*time.Hour))
+	}
+	if !c.Now().Equal(start.Add(36 * time.Hour)) {
+		t.Fatal("advance did not stick")
+	}
+}
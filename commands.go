@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// subcommands run instead of the server, e.g. `server simulate -buyers 20`
+func runCommand(name string, args []string) {
+	//config check reports invalid settings instead of failing on them
+	if name != "config" {
+		if err := loadSettings(nil); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid configuration:")
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var err error
+	switch name {
+	case "config":
+		err = configCommand(args)
+	case "simulate":
+		err = simulateCommand(args)
+	case "scenario":
+		err = scenarioCommand(args)
+	case "snapshot":
+		err = snapshotCommand(args)
+	case "seed":
+		err = seedCommand(args)
+	case "token":
+		err = tokenCommand(args)
+	case "role":
+		err = roleCommand(args)
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command: "+name)
+		fmt.Fprintln(os.Stderr, "commands: config, simulate, scenario, snapshot, seed, token, role")
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,357 @@
+// typed settings of the server and its commands. defaults are overridden by an optional YAML file,
+// then by the environment, then by flags, and every problem found is reported at once
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fields tagged secret are redacted when printed, secret:"url" only hides the password of a URL
+type Config struct {
+	Server     Server     `yaml:"server"`
+	Log        Log        `yaml:"log"`
+	Stores     Stores     `yaml:"stores"`
+	Auth       Auth       `yaml:"auth"`
+	Jobs       Jobs       `yaml:"jobs"`
+	Clock      Clock      `yaml:"clock"`
+	Listings   Listings   `yaml:"listings"`
+	Recommend  Recommend  `yaml:"recommender"`
+	Snapshots  Snapshots  `yaml:"snapshots"`
+	Simulation Simulation `yaml:"simulation"`
+}
+
+type Server struct {
+	Host              string        `yaml:"host" env:"HOST"`
+	Port              int           `yaml:"port" env:"PORT"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"SERVER_IDLE_TIMEOUT"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// debug, info, warn or error
+type Log struct {
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+type Stores struct {
+	PostgresURL    string `yaml:"postgresUrl" env:"POSTGRES_URL" secret:"url"`
+	RedisURL       string `yaml:"redisUrl" env:"REDIS_URL" secret:"url"`
+	StartupRetries int    `yaml:"startupRetries" env:"STARTUP_RETRIES"`
+}
+
+type Auth struct {
+	Provider            string `yaml:"provider" env:"AUTH_PROVIDER"`
+	FirebaseCredentials string `yaml:"firebaseCredentials" env:"FIREBASE_CREDENTIALS"`
+	JWTAlg              string `yaml:"jwtAlg" env:"JWT_ALG"`
+	JWTSecret           string `yaml:"jwtSecret" env:"JWT_SECRET" secret:"true"`
+	JWTPublicKey        string `yaml:"jwtPublicKey" env:"JWT_PUBLIC_KEY"`
+	JWTPrivateKey       string `yaml:"jwtPrivateKey" env:"JWT_PRIVATE_KEY"`
+	JWTIssuer           string `yaml:"jwtIssuer" env:"JWT_ISSUER"`
+}
+
+// the environment gives these in whole seconds, as before the config file existed
+type Jobs struct {
+	EconomyInterval time.Duration `yaml:"economyInterval" env:"ECONOMY_INTERVAL_SECONDS" unit:"s"`
+	PricingInterval time.Duration `yaml:"pricingInterval" env:"PRICING_INTERVAL_SECONDS" unit:"s"`
+	BanInterval     time.Duration `yaml:"banInterval" env:"BAN_INTERVAL_SECONDS" unit:"s"`
+}
+
+type Clock struct {
+	Mode string  `yaml:"mode" env:"CLOCK_MODE"`
+	Rate float64 `yaml:"rate" env:"CLOCK_RATE"`
+}
+
+type Listings struct {
+	Approval bool `yaml:"approval" env:"LISTING_APPROVAL"`
+}
+
+type Recommend struct {
+	URL     string        `yaml:"url" env:"RECOMMENDER_URL"`
+	Timeout time.Duration `yaml:"timeout" env:"RECOMMENDER_TIMEOUT_MS" unit:"ms"`
+}
+
+type Snapshots struct {
+	Dir string `yaml:"dir" env:"SNAPSHOT_DIR"`
+}
+
+// agents run inside the server when Buyers is above zero
+type Simulation struct {
+	Buyers   int           `yaml:"buyers" env:"SIM_BUYERS"`
+	Sellers  int           `yaml:"sellers" env:"SIM_SELLERS"`
+	Products int           `yaml:"products" env:"SIM_PRODUCTS"`
+	Rounds   int           `yaml:"rounds" env:"SIM_ROUNDS"`
+	Budget   float64       `yaml:"budget" env:"SIM_BUDGET"`
+	Interval time.Duration `yaml:"interval" env:"SIM_INTERVAL_MS" unit:"ms"`
+	Seed     int64         `yaml:"seed" env:"SIM_SEED"`
+	World    string        `yaml:"world" env:"SIM_WORLD"`
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Host:              "localhost",
+			Port:              8000,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Log:        Log{Level: "info"},
+		Stores:     Stores{StartupRetries: 5},
+		Auth:       Auth{Provider: "firebase", FirebaseCredentials: "serviceAccountKey.json", JWTAlg: "HS256"},
+		Jobs:       Jobs{EconomyInterval: time.Minute, PricingInterval: time.Minute, BanInterval: time.Minute},
+		Clock:      Clock{Mode: "real", Rate: 1},
+		Recommend:  Recommend{Timeout: 2 * time.Second},
+		Snapshots:  Snapshots{Dir: "snapshots"},
+		Simulation: Simulation{Sellers: 5, Products: 4, Budget: 500, Interval: time.Second, Seed: 1},
+	}
+}
+
+// the -config file and the settings given as flags
+type Overrides struct {
+	flags *flag.FlagSet
+	file  *string
+}
+
+// registers -config and a flag per setting named after its YAML path, such as -server.port
+func Flags(flags *flag.FlagSet) *Overrides {
+	o := &Overrides{flags: flags, file: flags.String("config", os.Getenv("CONFIG_FILE"), "YAML config file, CONFIG_FILE")}
+	walk(reflect.ValueOf(&Config{}).Elem(), "", func(path string, field reflect.StructField, _ reflect.Value) {
+		flags.String(path, "", field.Tag.Get("env"))
+	})
+	return o
+}
+
+// o is nil when there are no flags, the file is then taken from CONFIG_FILE
+func Load(o *Overrides) (Config, error) {
+	c := Default()
+	file := os.Getenv("CONFIG_FILE")
+	if o != nil {
+		file = *o.file
+	}
+	var problems []error
+	if file != "" {
+		if err := c.readFile(file); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	set := map[string]string{}
+	if o != nil {
+		o.flags.Visit(func(f *flag.Flag) {
+			if f.Name != "config" {
+				set[f.Name] = f.Value.String()
+			}
+		})
+	}
+	walk(reflect.ValueOf(&c).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("env")
+		if raw := os.Getenv(name); raw != "" {
+			if err := parse(value, raw, field.Tag.Get("unit")); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+		if raw, ok := set[path]; ok {
+			if err := parse(value, raw, ""); err != nil {
+				problems = append(problems, fmt.Errorf("-%s: %w", path, err))
+			}
+		}
+	})
+	problems = append(problems, c.Validate()...)
+	return c, errors.Join(problems...)
+}
+
+func (c *Config) readFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// every problem with the settings, empty if they are usable
+func (c Config) Validate() []error {
+	var problems []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Server.Host != "", "server.host is required")
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535, got %d", c.Server.Port)
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"server.readHeaderTimeout", c.Server.ReadHeaderTimeout}, {"server.readTimeout", c.Server.ReadTimeout},
+		{"server.writeTimeout", c.Server.WriteTimeout}, {"server.idleTimeout", c.Server.IdleTimeout},
+		{"server.shutdownTimeout", c.Server.ShutdownTimeout}, {"jobs.economyInterval", c.Jobs.EconomyInterval},
+		{"jobs.pricingInterval", c.Jobs.PricingInterval}, {"jobs.banInterval", c.Jobs.BanInterval},
+		{"recommender.timeout", c.Recommend.Timeout},
+	} {
+		check(d.value > 0, "%s must be positive, got %s", d.name, d.value)
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+
+	check(c.Stores.PostgresURL != "", "stores.postgresUrl (POSTGRES_URL) is required")
+	//lib/pq also takes key=value connection strings
+	if strings.Contains(c.Stores.PostgresURL, "://") {
+		u, err := url.Parse(c.Stores.PostgresURL)
+		check(err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql"), "stores.postgresUrl must be a postgres:// URL")
+	}
+	if c.Stores.RedisURL == "" {
+		check(false, "stores.redisUrl (REDIS_URL) is required")
+	} else {
+		u, err := url.Parse(c.Stores.RedisURL)
+		check(err == nil && (u.Scheme == "redis" || u.Scheme == "rediss" || u.Scheme == "unix"), "stores.redisUrl must be a redis://, rediss:// or unix:// URL")
+	}
+	check(c.Stores.StartupRetries >= 0, "stores.startupRetries cannot be negative")
+
+	switch c.Auth.Provider {
+	case "firebase":
+		_, err := os.Stat(c.Auth.FirebaseCredentials)
+		check(err == nil, "auth.firebaseCredentials: %v", err)
+	case "jwt":
+		switch c.Auth.JWTAlg {
+		case "HS256":
+			check(len(c.Auth.JWTSecret) >= 32, "auth.jwtSecret (JWT_SECRET) must be at least 32 characters for HS256")
+		case "RS256":
+			_, err := os.Stat(c.Auth.JWTPublicKey)
+			check(err == nil, "auth.jwtPublicKey (JWT_PUBLIC_KEY): %v", err)
+		default:
+			check(false, "auth.jwtAlg must be HS256 or RS256, got %q", c.Auth.JWTAlg)
+		}
+	default:
+		check(false, "auth.provider must be firebase or jwt, got %q", c.Auth.Provider)
+	}
+
+	check(c.Clock.Mode == "real" || c.Clock.Mode == "accelerated" || c.Clock.Mode == "frozen",
+		"clock.mode must be real, accelerated or frozen, got %q", c.Clock.Mode)
+	check(c.Clock.Rate > 0, "clock.rate must be positive")
+	if c.Recommend.URL != "" {
+		u, err := url.Parse(c.Recommend.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "recommender.url must be an http or https URL")
+	}
+	check(c.Snapshots.Dir != "", "snapshots.dir is required")
+
+	if c.Simulation.Buyers > 0 {
+		check(c.Simulation.Sellers > 0, "simulation.sellers must be positive when buyers are simulated")
+		check(c.Simulation.Products >= 0, "simulation.products cannot be negative")
+		check(c.Simulation.Rounds >= 0, "simulation.rounds cannot be negative")
+		check(c.Simulation.Budget > 0, "simulation.budget must be positive")
+		check(c.Simulation.Interval > 0, "simulation.interval must be positive")
+	}
+	check(c.Simulation.Buyers >= 0, "simulation.buyers cannot be negative")
+	return problems
+}
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// copy with the secrets replaced, safe to print or log
+func (c Config) Redacted() Config {
+	walk(reflect.ValueOf(&c).Elem(), "", func(_ string, field reflect.StructField, value reflect.Value) {
+		if value.Kind() != reflect.String || value.String() == "" {
+			return
+		}
+		switch field.Tag.Get("secret") {
+		case "true":
+			value.SetString("[redacted]")
+		case "url":
+			if u, err := url.Parse(value.String()); err == nil && strings.Contains(value.String(), "://") {
+				value.SetString(u.Redacted())
+			} else {
+				value.SetString(dsnPassword.ReplaceAllString(value.String(), "password=xxxxx"))
+			}
+		}
+	})
+	return c
+}
+
+// redacted YAML, so printing the config never shows a secret
+func (c Config) String() string {
+	buf, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(buf)
+}
+
+// calls fn for every setting with its YAML path
+func walk(v reflect.Value, prefix string, fn func(path string, field reflect.StructField, value reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		path := prefix + field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct {
+			walk(v.Field(i), path+".", fn)
+			continue
+		}
+		fn(path, field, v.Field(i))
+	}
+}
+
+// raw is a Go duration such as 90s, or a whole number of unit when the setting has one
+func parse(value reflect.Value, raw string, unit string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && unit != "" {
+			scale := time.Second
+			if unit == "ms" {
+				scale = time.Millisecond
+			}
+			value.SetInt(n * int64(scale))
+			return nil
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		value.SetFloat(f)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// empties every variable Load reads, empty values are ignored like unset ones
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	walk(reflect.ValueOf(&Config{}).Elem(), "", func(_ string, field reflect.StructField, _ reflect.Value) {
+		t.Setenv(field.Tag.Get("env"), "")
+	})
+}
+
+// the environment a JWT deployment needs to pass validation
+func setRequired(t *testing.T) {
+	t.Helper()
+	t.Setenv("POSTGRES_URL", "postgres://app:pw@db:5432/app")
+	t.Setenv("REDIS_URL", "redis://cache:6379/0")
+	t.Setenv("AUTH_PROVIDER", "jwt")
+	t.Setenv("JWT_SECRET", strings.Repeat("s", 32))
+}
+
+func valid() Config {
+	c := Default()
+	c.Stores.PostgresURL = "postgres://app:pw@db:5432/app"
+	c.Stores.RedisURL = "redis://cache:6379/0"
+	c.Auth.Provider = "jwt"
+	c.Auth.JWTSecret = strings.Repeat("s", 32)
+	return c
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"key value dsn", func(c *Config) { c.Stores.PostgresURL = "host=db user=app password=pw" }, ""},
+		{"port", func(c *Config) { c.Server.Port = 70000 }, "server.port"},
+		{"host", func(c *Config) { c.Server.Host = "" }, "server.host"},
+		{"timeout", func(c *Config) { c.Server.WriteTimeout = 0 }, "server.writeTimeout"},
+		{"interval", func(c *Config) { c.Jobs.BanInterval = -time.Second }, "jobs.banInterval"},
+		{"postgres missing", func(c *Config) { c.Stores.PostgresURL = "" }, "stores.postgresUrl"},
+		{"postgres scheme", func(c *Config) { c.Stores.PostgresURL = "mysql://db/app" }, "stores.postgresUrl"},
+		{"redis scheme", func(c *Config) { c.Stores.RedisURL = "http://cache" }, "stores.redisUrl"},
+		{"provider", func(c *Config) { c.Auth.Provider = "ldap" }, "auth.provider"},
+		{"short secret", func(c *Config) { c.Auth.JWTSecret = "short" }, "auth.jwtSecret"},
+		{"algorithm", func(c *Config) { c.Auth.JWTAlg = "ES256" }, "auth.jwtAlg"},
+		{"public key", func(c *Config) { c.Auth.JWTAlg, c.Auth.JWTPublicKey = "RS256", "missing.pem" }, "auth.jwtPublicKey"},
+		{"firebase credentials", func(c *Config) { c.Auth.Provider, c.Auth.FirebaseCredentials = "firebase", "missing.json" }, "auth.firebaseCredentials"},
+		{"clock mode", func(c *Config) { c.Clock.Mode = "fast" }, "clock.mode"},
+		{"clock rate", func(c *Config) { c.Clock.Rate = 0 }, "clock.rate"},
+		{"log level", func(c *Config) { c.Log.Level = "verbose" }, "log.level"},
+		{"recommender", func(c *Config) { c.Recommend.URL = "recommender:9000" }, "recommender.url"},
+		{"simulation off", func(c *Config) { c.Simulation.Sellers = 0 }, ""},
+		{"simulation sellers", func(c *Config) { c.Simulation.Buyers, c.Simulation.Sellers = 10, 0 }, "simulation.sellers"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := valid()
+			test.change(&c)
+			problems := c.Validate()
+			if test.want == "" {
+				if len(problems) > 0 {
+					t.Fatalf("unexpected problems: %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0].Error(), test.want) {
+				t.Fatalf("want one problem about %s, got %v", test.want, problems)
+			}
+		})
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("PORT", "http")
+	t.Setenv("CLOCK_MODE", "fast")
+	_, err := Load(nil)
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	for _, want := range []string{"PORT: invalid integer", "clock.mode", "stores.postgresUrl", "stores.redisUrl", "auth.firebaseCredentials"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	file := writeFile(t, "server:\n  host: file\n  port: 9000\nclock:\n  rate: 2\n")
+	t.Setenv("PORT", "9100")
+	t.Setenv("CLOCK_RATE", "3")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := Flags(flags)
+	if err := flags.Parse([]string{"-config", file, "-server.port", "9200"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Port != 9200 {
+		t.Errorf("flag should win over env and file, port %d", c.Server.Port)
+	}
+	if c.Clock.Rate != 3 {
+		t.Errorf("env should win over file, rate %v", c.Clock.Rate)
+	}
+	if c.Server.Host != "file" {
+		t.Errorf("file should win over defaults, host %q", c.Server.Host)
+	}
+	if c.Server.ReadTimeout != 15*time.Second {
+		t.Errorf("default should be kept, read timeout %s", c.Server.ReadTimeout)
+	}
+}
+
+func TestLoadFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "listings:\n  approval: true\n"))
+	c, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Listings.Approval {
+		t.Error("CONFIG_FILE was not read")
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "server:\n  prot: 9000\n"))
+	_, err := Load(nil)
+	if err == nil || !strings.Contains(err.Error(), "field prot not found") {
+		t.Fatalf("want an unknown field error, got %v", err)
+	}
+}
+
+func TestLoadUnits(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		raw  string
+		get  func(c Config) time.Duration
+		want time.Duration
+	}{
+		{"seconds", "ECONOMY_INTERVAL_SECONDS", "90", func(c Config) time.Duration { return c.Jobs.EconomyInterval }, 90 * time.Second},
+		{"seconds as duration", "BAN_INTERVAL_SECONDS", "2m", func(c Config) time.Duration { return c.Jobs.BanInterval }, 2 * time.Minute},
+		{"milliseconds", "RECOMMENDER_TIMEOUT_MS", "250", func(c Config) time.Duration { return c.Recommend.Timeout }, 250 * time.Millisecond},
+		{"milliseconds as duration", "SIM_INTERVAL_MS", "1.5s", func(c Config) time.Duration { return c.Simulation.Interval }, 1500 * time.Millisecond},
+		{"no unit", "SERVER_READ_TIMEOUT", "20s", func(c Config) time.Duration { return c.Server.ReadTimeout }, 20 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			setRequired(t)
+			t.Setenv(test.env, test.raw)
+			c, err := Load(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := test.get(c); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// flags are named after the YAML path and take Go durations, a bare number has no unit there
+func TestLoadFlagDurations(t *testing.T) {
+	clearEnv(t)
+	setRequired(t)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := Flags(flags)
+	if err := flags.Parse([]string{"-jobs.pricingInterval", "45"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(overrides); err == nil || !strings.Contains(err.Error(), "-jobs.pricingInterval: invalid duration") {
+		t.Fatalf("want an invalid duration error, got %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := valid()
+	c.Stores.RedisURL = "redis://:hunter2@cache:6379/0"
+	c.Auth.JWTSecret = "correct horse battery staple, very long"
+	redacted := c.Redacted()
+	if redacted.Stores.PostgresURL != "postgres://app:xxxxx@db:5432/app" {
+		t.Errorf("postgres url %q", redacted.Stores.PostgresURL)
+	}
+	if redacted.Stores.RedisURL != "redis://:xxxxx@cache:6379/0" {
+		t.Errorf("redis url %q", redacted.Stores.RedisURL)
+	}
+	if redacted.Auth.JWTSecret != "[redacted]" {
+		t.Errorf("jwt secret %q", redacted.Auth.JWTSecret)
+	}
+	if c.Auth.JWTSecret != "correct horse battery staple, very long" {
+		t.Error("Redacted changed the original")
+	}
+
+	c.Stores.PostgresURL = "host=db user=app password=pw sslmode=disable"
+	if got := c.Redacted().Stores.PostgresURL; got != "host=db user=app password=xxxxx sslmode=disable" {
+		t.Errorf("dsn %q", got)
+	}
+	printed := c.String()
+	for _, secret := range []string{"hunter2", "correct horse", "password=pw"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("printed config contains %q:\n%s", secret, printed)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+type economySnapshot struct {
+	Taken          time.Time           `json:"taken"`
+	MoneySupply    float64             `json:"moneySupply"`
+	Transactions   int                 `json:"transactions"`
+	Volume         float64             `json:"volume"`
+	InventoryValue float64             `json:"inventoryValue"`
+	Listings       int                 `json:"listings"`
+	Departments    []departmentMetrics `json:"departments,omitempty"`
+}
+
+type departmentMetrics struct {
+	Department   string  `json:"department"`
+	AveragePrice float64 `json:"averagePrice"`
+	Listings     int     `json:"listings"`
+	Units        int     `json:"units"`
+}
+
+// metrics of one world, transactions and volume count the orders placed after since
+func computeEconomy(ctx context.Context, db *sql.DB, world string, since time.Time) (economySnapshot, error) {
+	s := economySnapshot{Taken: clock.Now()}
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(balance), 0) FROM Cards WHERE world_id = $1;", world).Scan(&s.MoneySupply); err != nil {
+		return s, err
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(quantity * price), 0) FROM Orders"+
+		" WHERE world_id = $1 AND created > $2 AND created <= $3;",
+		world, since, s.Taken).Scan(&s.Transactions, &s.Volume); err != nil {
+		return s, err
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(quantity * price), 0), COUNT(*) FROM Products WHERE status = 'A' AND world_id = $1;", world).
+		Scan(&s.InventoryValue, &s.Listings); err != nil {
+		return s, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT department, AVG(price), COUNT(*), COALESCE(SUM(quantity), 0) FROM Products"+
+		" WHERE status = 'A' AND world_id = $1 GROUP BY department ORDER BY department;", world)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d departmentMetrics
+		if err := rows.Scan(&d.Department, &d.AveragePrice, &d.Listings, &d.Units); err != nil {
+			return s, err
+		}
+		s.Departments = append(s.Departments, d)
+	}
+	return s, rows.Err()
+}
+
+func storeEconomy(ctx context.Context, db *sql.DB, world string, s economySnapshot) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id string
+	if err := tx.QueryRowContext(ctx, "INSERT INTO EconomySnapshots(taken, money_supply, transactions, volume, inventory_value, listings, world_id)"+
+		" VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id;", s.Taken, s.MoneySupply, s.Transactions, s.Volume, s.InventoryValue, s.Listings, world).
+		Scan(&id); err != nil {
+		return err
+	}
+	for _, d := range s.Departments {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO DepartmentSnapshots(snapshot_id, department, average_price, listings, units)"+
+			" VALUES($1, $2, $3, $4, $5);", id, d.Department, d.AveragePrice, d.Listings, d.Units); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// snapshots the economy of every world each jobs.economyInterval (a minute by default) until ctx is cancelled
+func runEconomyMetrics(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(settings.Jobs.EconomyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := snapshotEconomies(ctx, db); err != nil {
+				log.Printf("economy snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+// each world's transactions are counted from its own last snapshot
+func snapshotEconomies(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT Worlds.id, COALESCE(MAX(EconomySnapshots.taken), 'epoch') FROM Worlds"+
+		" LEFT JOIN EconomySnapshots ON EconomySnapshots.world_id = Worlds.id GROUP BY Worlds.id ORDER BY Worlds.id;")
+	if err != nil {
+		return err
+	}
+	since := map[string]time.Time{}
+	var worlds []string
+	for rows.Next() {
+		var world string
+		var taken time.Time
+		if err := rows.Scan(&world, &taken); err != nil {
+			rows.Close()
+			return err
+		}
+		worlds = append(worlds, world)
+		since[world] = taken
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, world := range worlds {
+		s, err := computeEconomy(ctx, db, world, since[world])
+		if err == nil {
+			err = storeEconomy(ctx, db, world, s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// live metrics, transactions cover the time since the last stored snapshot
+func economyGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var since time.Time
+	if err := db.QueryRow("SELECT COALESCE(MAX(taken), 'epoch') FROM EconomySnapshots WHERE world_id = $1;", worldOf(c)).Scan(&since); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	s, err := computeEconomy(c.Request.Context(), db, worldOf(c), since)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"economy": s, "since": since})
+}
+
+// stored snapshots oldest first, optionally between from and to
+func economyHistoryGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	filter, args := economyRange(c)
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	snapshots := []economySnapshot{}
+	rows, err := db.Query("SELECT taken, money_supply, transactions, volume, inventory_value, listings FROM ("+
+		"SELECT * FROM EconomySnapshots WHERE TRUE"+filter+" ORDER BY taken DESC LIMIT "+strconv.Itoa(limit)+
+		" OFFSET "+strconv.Itoa(offset)+") AS recent ORDER BY taken;", args...)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s economySnapshot
+		if err := rows.Scan(&s.Taken, &s.MoneySupply, &s.Transactions, &s.Volume, &s.InventoryValue, &s.Listings); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		snapshots = append(snapshots, s)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"snapshots": snapshots})
+}
+
+// per department series, optionally for a single department
+func economyDepartmentsGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	filter, args := economyRange(c)
+	if department := c.Query("department"); department != "" {
+		args = append(args, department)
+		filter += " AND department = $" + strconv.Itoa(len(args))
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var series []struct {
+		Taken time.Time `json:"taken"`
+		departmentMetrics
+	}
+	rows, err := db.Query("SELECT taken, department, average_price, listings, units FROM ("+
+		"SELECT EconomySnapshots.taken, DepartmentSnapshots.* FROM DepartmentSnapshots JOIN EconomySnapshots"+
+		" ON EconomySnapshots.id = DepartmentSnapshots.snapshot_id WHERE TRUE"+filter+
+		" ORDER BY taken DESC, department LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+") AS recent ORDER BY taken, department;", args...)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var point struct {
+			Taken time.Time `json:"taken"`
+			departmentMetrics
+		}
+		if err := rows.Scan(&point.Taken, &point.Department, &point.AveragePrice, &point.Listings, &point.Units); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		series = append(series, point)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"departments": series})
+}
+
+func economyRange(c *gin.Context) (string, []any) {
+	filter := " AND world_id = $1"
+	args := []any{worldOf(c)}
+	if value := c.Query("from"); value != "" {
+		args = append(args, value)
+		filter += " AND taken >= $" + strconv.Itoa(len(args))
+	}
+	if value := c.Query("to"); value != "" {
+		args = append(args, value)
+		filter += " AND taken < $" + strconv.Itoa(len(args))
+	}
+	return filter, args
+}
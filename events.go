@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	eventView     = "view"
+	eventSearch   = "search"
+	eventCart     = "cart"
+	eventPurchase = "purchase"
+)
+
+// behavioral event, user is empty for anonymous visitors
+type event struct {
+	Kind     string
+	World    string
+	User     string
+	Product  string
+	Query    string
+	Results  int
+	Quantity int
+	Created  time.Time
+}
+
+// buffers events in memory and writes them to Postgres in batches
+type eventRecorder struct {
+	db       *sql.DB
+	queue    chan event
+	batch    int
+	interval time.Duration
+	done     chan struct{}
+}
+
+func newEventRecorder(db *sql.DB) *eventRecorder {
+	return &eventRecorder{
+		db:       db,
+		queue:    make(chan event, 4096),
+		batch:    200,
+		interval: 5 * time.Second,
+		done:     make(chan struct{}),
+	}
+}
+
+// never blocks a request, events are dropped when the buffer is full
+func (r *eventRecorder) record(e event) {
+	if e.Created.IsZero() {
+		e.Created = clock.Now()
+	}
+	select {
+	case r.queue <- e:
+	default:
+	}
+}
+
+// writes batches until ctx is cancelled, then flushes whatever is still buffered
+func (r *eventRecorder) run(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	var pending []event
+	for {
+		select {
+		case e := <-r.queue:
+			pending = append(pending, e)
+			if len(pending) >= r.batch {
+				r.flush(pending)
+				pending = nil
+			}
+		case <-ticker.C:
+			r.flush(pending)
+			pending = nil
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-r.queue:
+					pending = append(pending, e)
+				default:
+					r.flush(pending)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *eventRecorder) flush(events []event) {
+	if len(events) == 0 {
+		return
+	}
+	values := make([]string, 0, len(events))
+	args := make([]any, 0, len(events)*8)
+	for i, e := range events {
+		n := i * 8
+		values = append(values, "($"+strconv.Itoa(n+1)+", $"+strconv.Itoa(n+2)+", $"+strconv.Itoa(n+3)+", $"+
+			strconv.Itoa(n+4)+", $"+strconv.Itoa(n+5)+", $"+strconv.Itoa(n+6)+", $"+strconv.Itoa(n+7)+", $"+strconv.Itoa(n+8)+")")
+		if e.World == "" {
+			e.World = defaultWorld
+		}
+		args = append(args, e.Kind, nullable(e.User), nullable(e.Product), nullable(e.Query),
+			sql.NullInt64{Int64: int64(e.Results), Valid: e.Kind == eventSearch},
+			sql.NullInt64{Int64: int64(e.Quantity), Valid: e.Quantity > 0}, e.Created, e.World)
+	}
+	_, err := r.db.Exec("INSERT INTO Events(kind, user_id, product_id, query, results, quantity, created, world_id) VALUES "+
+		strings.Join(values, ", ")+";", args...)
+	if err == nil {
+		return
+	}
+	if len(events) == 1 {
+		log.Printf("dropped an event: %v", err)
+		return
+	}
+	//one bad row fails the whole batch, retried row by row so only that one is lost
+	for _, e := range events {
+		r.flush([]event{e})
+	}
+}
+
+func nullable(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// user id set by authenticate, empty if the request is anonymous
+func eventUser(c *gin.Context) string {
+	if uid, exists := c.Get(userKey); exists {
+		return uid.(string)
+	}
+	return ""
+}
+
+// events reported by clients, currently only cart adds since the cart lives in the frontend
+func eventPost(c *gin.Context, db *sql.DB, rdb *redis.Client, events *eventRecorder) {
+	var e struct {
+		Kind     string `json:"kind" binding:"required,oneof=cart"`
+		Product  string `json:"product" binding:"required,number"`
+		Quantity int    `json:"quantity" binding:"omitempty,min=1"`
+	}
+	if err := c.BindJSON(&e); err != nil {
+		return
+	}
+	if _, err := strconv.ParseInt(e.Product, 10, 32); err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	var listed bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Products WHERE id = $1 AND world_id = $2);", e.Product, worldOf(c)).Scan(&listed); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !listed {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	events.record(event{Kind: e.Kind, World: worldOf(c), User: eventUser(c), Product: e.Product, Quantity: e.Quantity})
+	c.Status(http.StatusAccepted)
+}
+
+func eventGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	filter := " AND world_id = $1"
+	args := []any{worldOf(c)}
+	for _, term := range [...]string{"kind", "user_id", "product_id"} {
+		if value := c.Query(term); value != "" {
+			args = append(args, value)
+			filter += " AND " + term + " = $" + strconv.Itoa(len(args))
+		}
+	}
+	if value := c.Query("from"); value != "" {
+		args = append(args, value)
+		filter += " AND created >= $" + strconv.Itoa(len(args))
+	}
+	if value := c.Query("to"); value != "" {
+		args = append(args, value)
+		filter += " AND created < $" + strconv.Itoa(len(args))
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var events []struct {
+		Kind      string `json:"kind"`
+		User      string `json:"user,omitempty"`
+		Product   string `json:"product,omitempty"`
+		Query     string `json:"query,omitempty"`
+		Results   string `json:"results,omitempty"`
+		Quantity  string `json:"quantity,omitempty"`
+		Timestamp string `json:"timestamp"`
+	}
+	rows, err := db.Query("SELECT kind, COALESCE(user_id::text, ''), COALESCE(product_id::text, ''), COALESCE(query, ''),"+
+		" COALESCE(results::text, ''), COALESCE(quantity::text, ''), created FROM Events WHERE TRUE"+filter+
+		" ORDER BY created DESC LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", args...)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e struct {
+			Kind      string `json:"kind"`
+			User      string `json:"user,omitempty"`
+			Product   string `json:"product,omitempty"`
+			Query     string `json:"query,omitempty"`
+			Results   string `json:"results,omitempty"`
+			Quantity  string `json:"quantity,omitempty"`
+			Timestamp string `json:"timestamp"`
+		}
+		if err := rows.Scan(&e.Kind, &e.User, &e.Product, &e.Query, &e.Results, &e.Quantity, &e.Timestamp); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		events = append(events, e)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"events": events})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"example/ecommsimapis/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var started = time.Now()
+
+type dependency struct {
+	Ok      bool    `json:"ok"`
+	Latency float64 `json:"latencyMs"`
+	Error   string  `json:"error,omitempty"`
+}
+
+func ping(ctx context.Context, check func(ctx context.Context) error) dependency {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	d := dependency{Ok: err == nil, Latency: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	return d
+}
+
+// reachability and latency of the stores and of Firebase when it verifies tokens, errors name internal hosts and are only shown to moderators
+func checkDependencies(ctx context.Context, provider AuthProvider, db *sql.DB, rdb *redis.Client) map[string]dependency {
+	dependencies := map[string]dependency{
+		"postgres": ping(ctx, db.PingContext),
+		"redis":    ping(ctx, func(ctx context.Context) error { return rdb.Ping(ctx).Err() }),
+	}
+	if firebase, ok := provider.(*firebaseProvider); ok {
+		dependencies["firebase"] = ping(ctx, firebase.Ping)
+	}
+	return dependencies
+}
+
+// the process is up, for liveness probes
+func healthGet(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Postgres is required to serve, without Redis or Firebase the server runs degraded and still answers 200
+func readyGet(c *gin.Context, provider AuthProvider, db *sql.DB, rdb *redis.Client) {
+	dependencies := checkDependencies(c.Request.Context(), provider, db, rdb)
+	status, code := "ready", http.StatusOK
+	firebase, verifying := dependencies["firebase"]
+	if !dependencies["postgres"].Ok {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	} else if !dependencies["redis"].Ok || (verifying && !firebase.Ok) {
+		status = "degraded"
+	}
+	//the endpoint is public
+	for name, d := range dependencies {
+		d.Error = ""
+		dependencies[name] = d
+	}
+	c.IndentedJSON(code, gin.H{"status": status, "dependencies": dependencies})
+}
+
+// dependencies with their errors, connection pools, cache hit rates, breakers and the running build, for moderators
+func statusGet(c *gin.Context, provider AuthProvider, db *sql.DB, rdb *redis.Client) {
+	build := gin.H{"version": version}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build["go"] = info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				build[setting.Key] = setting.Value
+			}
+		}
+	}
+	pool := db.Stats()
+	redisPool := rdb.PoolStats()
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"build":   build,
+		"started": started.UTC().Format(time.RFC3339),
+		"uptime":  time.Since(started).Round(time.Second).String(),
+		"postgres": gin.H{
+			"open":         pool.OpenConnections,
+			"inUse":        pool.InUse,
+			"idle":         pool.Idle,
+			"maxOpen":      pool.MaxOpenConnections,
+			"waitCount":    pool.WaitCount,
+			"waitDuration": pool.WaitDuration.String(),
+		},
+		"redis": gin.H{
+			"total":    redisPool.TotalConns,
+			"idle":     redisPool.IdleConns,
+			"stale":    redisPool.StaleConns,
+			"hits":     redisPool.Hits,
+			"misses":   redisPool.Misses,
+			"timeouts": redisPool.Timeouts,
+		},
+		"dependencies": checkDependencies(c.Request.Context(), provider, db, rdb),
+		"breakers":     gin.H{"redis": redisBreaker.state(), "firebase": firebaseBreaker.state()},
+		"cache":        cache.Snapshot(),
+	})
+}
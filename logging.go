@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// attributes and query parameters never written to the log
+var sensitiveKeys = map[string]bool{
+	"authorization": true, "card": true, "code": true, "number": true, "password": true, "secret": true, "token": true,
+}
+
+// key=value and key: value pairs of sensitive fields and 12 to 19 digit card numbers inside messages and errors
+var (
+	sensitivePairs = regexp.MustCompile(`(?i)\b(authorization|card|code|number|password|secret|token)(\s*[=:]\s*["']?)[^\s&"',;)]+`)
+	cardNumbers    = regexp.MustCompile(`\b\d{12,19}\b`)
+)
+
+func redact(s string) string {
+	return cardNumbers.ReplaceAllString(sensitivePairs.ReplaceAllString(s, "${1}${2}[redacted]"), "[redacted]")
+}
+
+// JSON lines on stdout at log.level, the standard log package writes through it too
+func newLogger() *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(settings.Log.Level))
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if sensitiveKeys[strings.ToLower(a.Key)] {
+				return slog.String(a.Key, "[redacted]")
+			}
+			if a.Value.Kind() == slog.KindString {
+				return slog.String(a.Key, redact(a.Value.String()))
+			}
+			return a
+		},
+	}))
+}
+
+// answers status and keeps err for the request log, the client only sees the status
+func fail(c *gin.Context, status int, err error) {
+	if err != nil {
+		c.Error(err)
+	}
+	c.Status(status)
+}
+
+// a panicking handler answers 500 and the panic is logged with its request instead of on its own
+var recoverRequest = gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+	c.Error(fmt.Errorf("panic: %v", recovered))
+	c.AbortWithStatus(http.StatusInternalServerError)
+})
+
+// one line per request with its id, user, route and latency, and the errors behind any non-2xx status
+func logRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	attrs := []slog.Attr{
+		slog.String("requestId", c.GetString(requestKey)),
+		slog.String("method", c.Request.Method),
+		slog.String("route", c.FullPath()),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", status),
+		slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+		slog.Int("bytes", max(c.Writer.Size(), 0)),
+		slog.String("clientIp", c.ClientIP()),
+	}
+	if query := c.Request.URL.Query(); len(query) > 0 {
+		for key := range query {
+			if sensitiveKeys[strings.ToLower(key)] {
+				query[key] = []string{"[redacted]"}
+			}
+		}
+		//unescaped so the redacted query stays readable
+		encoded, _ := url.QueryUnescape(query.Encode())
+		attrs = append(attrs, slog.String("query", encoded))
+	}
+	if world, exists := c.Get("world"); exists {
+		attrs = append(attrs, slog.String("world", fmt.Sprint(world)))
+	}
+	if user := c.GetString(userKey); user != "" {
+		attrs = append(attrs, slog.String("user", user))
+	}
+	level := slog.LevelInfo
+	if status < 200 || status > 299 {
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", strings.Join(c.Errors.Errors(), "; ")))
+		}
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+	}
+	slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+}
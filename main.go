@@ -2,141 +2,296 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
-	firebase "firebase.google.com/go"
-	"firebase.google.com/go/auth"
+	"example/ecommsimapis/cache"
+	"example/ecommsimapis/config"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
-	"google.golang.org/api/option"
 )
 
 func main() {
-	if err := godotenv.Load(".env"); err != nil {
-		panic("environmental variable file not found")
+	//the environment can also come from the container or the shell
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		panic("environmental variable file unreadable: " + err.Error())
 	}
-	options := option.WithCredentialsFile("serviceAccountKey.json")
-
-	fb, err := firebase.NewApp(context.Background(), nil, options)
-	if err != nil {
-		panic("firebase connection failed")
-	}
-	fba, err := fb.Auth(context.Background())
-	if err != nil {
-		panic("firebase auth failed")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runCommand(os.Args[1], os.Args[2:])
+		return
 	}
-	opt, err := redis.ParseURL(os.Getenv("REDIS_URL"))
-	if err != nil {
-		panic("redis connection failed")
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	overrides := config.Flags(flags)
+	flags.Parse(os.Args[1:])
+	if err := loadSettings(overrides); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	rdb := redis.NewClient(opt)
-	connStr := os.Getenv("POSTGRES_URL")
-	db, err := sql.Open("postgres", connStr)
+	slog.SetDefault(newLogger())
+	provider, err := newAuthProvider()
 	if err != nil {
-		panic("postgres connection failed")
-	}
-	app := gin.Default()
+		panic(err.Error())
+	}
+	db, rdb := connect()
+	recommender := newRecommender(db)
+	//the recorder outlives the other jobs so the events they record on the way out are written
+	events := newEventRecorder(db)
+	recording, stopRecording := context.WithCancel(context.Background())
+	go events.run(recording)
+	jobs := newWorkers()
+	jobs.start(func(ctx context.Context) { runEconomyMetrics(ctx, db) })
+	jobs.start(func(ctx context.Context) { runPricing(ctx, db, rdb) })
+	jobs.start(func(ctx context.Context) { runBanExpiry(ctx, db, rdb) })
+	if cfg, enabled := simConfigFromSettings(); enabled {
+		jobs.start(func(ctx context.Context) { runSimulation(ctx, cfg, db, rdb, events) })
+	}
+	app := gin.New()
 
 	authMW := func(c *gin.Context) {
-		//DEVELOPMENT_ONLY_AUTHENTICATION_TEST(c, false)
-		authenticate(c, fba, false, db, rdb)
+		authenticate(c, provider, false, db, rdb)
 	}
 
 	optAuthMW := func(c *gin.Context) {
-		//DEVELOPMENT_ONLY_AUTHENTICATION_TEST(c, true)
-		authenticate(c, fba, true, db, rdb)
+		authenticate(c, provider, true, db, rdb)
 	}
 
 	statusMW := func(c *gin.Context) {
 		checkStatus(c, db, rdb)
 	}
 
-	//api status
-	app.GET("/", func(c *gin.Context) { indexGet(c, db, rdb) })
-	//public user info
-	app.GET("/users/:id", func(c *gin.Context) { userGet(c, db, rdb) })
-	//unban user
-	app.PUT("/users/:id", authMW, statusMW, func(c *gin.Context) { userPut(c, db, rdb) })
-	//user profile
-	app.PATCH("/users", authMW, func(c *gin.Context) { userPatch(c, db, rdb) })
-	//ban user
-	app.DELETE("/users/:id", authMW, statusMW, func(c *gin.Context) { userDelete(c, db, rdb) })
-	//user cards
-	app.GET("/cards", authMW, func(c *gin.Context) { cardGet(c, db, rdb) })
-	//new card: should have auto generated card id's
-	app.POST("/cards", authMW, func(c *gin.Context) { cardPost(c, db, rdb) })
-	//product info: should have image retrieval
-	app.GET("/products/:id", optAuthMW, func(c *gin.Context) { productGet(c, db, rdb) })
-	//manual search
-	app.GET("/products", optAuthMW, func(c *gin.Context) { productSearch(c, db, rdb) })
-	//product creation
-	app.POST("/products", authMW, func(c *gin.Context) { productPost(c, db, rdb) })
-	//change product's visibility
-	app.PUT("/products/:id", authMW, func(c *gin.Context) { productPut(c, db, rdb) })
-	//change product's stock
-	app.PATCH("/products/:id", authMW, func(c *gin.Context) { productPatch(c, db, rdb) })
-	//product deletion (changes the status in the database)
-	app.DELETE("/products/:id", authMW, func(c *gin.Context) { productDelete(c, db, rdb) })
-	//reviews for product
-	app.GET("/reviews/:id", func(c *gin.Context) { reviewGet(c, db, rdb) })
-	//make review
-	app.POST("/reviews", authMW, func(c *gin.Context) { reviewPost(c, db, rdb) })
-	//get purchase history
-	app.GET("/orders", authMW, func(c *gin.Context) { orderGet(c, db, rdb) })
-	//purchase
-	app.POST("/orders", authMW, func(c *gin.Context) { orderPost(c, db, rdb) })
-	//view orders to your products
-	app.GET("/orders/queue", authMW, func(c *gin.Context) { orderQueueGet(c, db, rdb) })
-	//account creation
-	app.POST("/signup", func(c *gin.Context) { signup(c, fba, db, rdb) })
-	port := os.Getenv("PORT")
-	if err := app.Run("localhost:" + port); err != nil {
-		app.Run("localhost:8000")
+	//actions across worlds are authorized by roles in the default world, an admin of a sandbox world cannot reach them
+	globalMW := func(c *gin.Context) {
+		c.Set("world", defaultWorld)
+		c.Next()
+	}
+
+	can := func(permission string) gin.HandlerFunc {
+		return func(c *gin.Context) { requirePermission(c, db, rdb, permission) }
+	}
+
+	//request id for the audit log and the request log, taken from X-Request-Id or generated
+	app.Use(requestId, logRequest, recoverRequest)
+	//every request belongs to a world, picked by the /worlds/:world prefix or the X-World header
+	app.Use(func(c *gin.Context) { selectWorld(c, db) })
+
+	routes := func(r gin.IRoutes) {
+		//api status
+		r.GET("/", func(c *gin.Context) { indexGet(c, db, rdb) })
+		//public user info
+		r.GET("/users/:id", func(c *gin.Context) { userGet(c, db, rdb) })
+		//unban user
+		r.PUT("/users/:id", authMW, statusMW, can(permBan), func(c *gin.Context) { userPut(c, db, rdb) })
+		//user profile
+		r.PATCH("/users", authMW, statusMW, func(c *gin.Context) { userPatch(c, db, rdb) })
+		//ban user
+		r.DELETE("/users/:id", authMW, statusMW, can(permBan), func(c *gin.Context) { userDelete(c, db, rdb) })
+		//user's bans, active and lifted
+		r.GET("/users/:id/bans", authMW, statusMW, can(permBan), func(c *gin.Context) { userBansGet(c, db, rdb) })
+		//banned user's appeal against their ban
+		r.POST("/appeals", authMW, func(c *gin.Context) { appealPost(c, db, rdb) })
+		//appeals waiting for a decision
+		r.GET("/appeals", authMW, statusMW, can(permBan), func(c *gin.Context) { appealsGet(c, db, rdb) })
+		//accept or reject an appeal
+		r.PUT("/appeals/:id", authMW, statusMW, can(permBan), func(c *gin.Context) { appealPut(c, db, rdb) })
+		//user's roles and their history
+		r.GET("/users/:id/roles", authMW, statusMW, can(permRoles), func(c *gin.Context) { userRolesGet(c, db, rdb) })
+		//grant a role
+		r.PUT("/users/:id/roles/:role", authMW, statusMW, can(permRoles), func(c *gin.Context) { userRolePut(c, db, rdb) })
+		//revoke a role
+		r.DELETE("/users/:id/roles/:role", authMW, statusMW, can(permRoles), func(c *gin.Context) { userRoleDelete(c, db, rdb) })
+		//roles and the permissions they grant
+		r.GET("/roles", func(c *gin.Context) { rolesGet(c, db, rdb) })
+		//user cards
+		r.GET("/cards", authMW, func(c *gin.Context) { cardGet(c, db, rdb) })
+		//new card: should have auto generated card id's
+		r.POST("/cards", authMW, statusMW, func(c *gin.Context) { cardPost(c, db, rdb) })
+		//product info: should have image retrieval
+		r.GET("/products/:id", optAuthMW, func(c *gin.Context) { productGet(c, db, rdb, events) })
+		//manual search
+		r.GET("/products", optAuthMW, func(c *gin.Context) { productSearch(c, db, rdb, events) })
+		//products bought together with this product
+		r.GET("/products/:id/related", func(c *gin.Context) { relatedGet(c, db, rdb, recommender) })
+		//recommendations based on purchase history
+		r.GET("/recommendations", authMW, func(c *gin.Context) { recommendationsGet(c, db, rdb, recommender) })
+		//popular products over the last hour, day or week
+		r.GET("/trending", func(c *gin.Context) { trendingGet(c, db, rdb) })
+		//most units sold in a department
+		r.GET("/bestsellers", func(c *gin.Context) { bestsellersGet(c, db, rdb) })
+		//sellers ranked by revenue
+		r.GET("/leaderboard", func(c *gin.Context) { leaderboardGet(c, db, rdb) })
+		//product creation
+		r.POST("/products", authMW, statusMW, can(permSell), func(c *gin.Context) { productPost(c, db, rdb) })
+		//change product's visibility
+		r.PUT("/products/:id", authMW, statusMW, can(permSell), func(c *gin.Context) { productPut(c, db, rdb) })
+		//change product's stock
+		r.PATCH("/products/:id", authMW, statusMW, can(permSell), func(c *gin.Context) { productPatch(c, db, rdb) })
+		//product deletion (changes the status in the database)
+		r.DELETE("/products/:id", authMW, statusMW, can(permSell), func(c *gin.Context) { productDelete(c, db, rdb) })
+		//approve, reject, take down or restore a listing
+		r.PUT("/products/:id/moderation", authMW, statusMW, can(permModerate), func(c *gin.Context) { productModerationPut(c, db, rdb) })
+		//listings waiting for approval or taken down
+		r.GET("/moderation/products", authMW, statusMW, can(permModerate), func(c *gin.Context) { moderationQueueGet(c, db, rdb) })
+		//seller's pricing rule for a product
+		r.GET("/products/:id/pricing", authMW, func(c *gin.Context) { pricingGet(c, db, rdb) })
+		//set demand, clearance, floor and ceiling pricing for a product
+		r.PUT("/products/:id/pricing", authMW, statusMW, can(permSell), func(c *gin.Context) { pricingPut(c, db, rdb) })
+		//stop automatic pricing for a product
+		r.DELETE("/products/:id/pricing", authMW, statusMW, can(permSell), func(c *gin.Context) { pricingDelete(c, db, rdb) })
+		//price changes of a product
+		r.GET("/products/:id/prices", func(c *gin.Context) { priceHistoryGet(c, db, rdb) })
+		//reviews for product
+		r.GET("/reviews/:id", func(c *gin.Context) { reviewGet(c, db, rdb) })
+		//make review
+		r.POST("/reviews", authMW, statusMW, can(permReview), func(c *gin.Context) { reviewPost(c, db, rdb) })
+		//mark review as helpful or unhelpful (id is the review's id)
+		r.PUT("/reviews/:id/vote", authMW, statusMW, func(c *gin.Context) { reviewVotePut(c, db, rdb) })
+		//remove vote on review
+		r.DELETE("/reviews/:id/vote", authMW, statusMW, func(c *gin.Context) { reviewVoteDelete(c, db, rdb) })
+		//seller reply to a review on their product, replying again edits the reply
+		r.PUT("/reviews/:id/reply", authMW, statusMW, func(c *gin.Context) { reviewReplyPut(c, db, rdb) })
+		//get purchase history
+		r.GET("/orders", authMW, func(c *gin.Context) { orderGet(c, db, rdb) })
+		//purchase
+		r.POST("/orders", authMW, statusMW, can(permBuy), func(c *gin.Context) { orderPost(c, db, rdb, events) })
+		//view orders to your products
+		r.GET("/orders/queue", authMW, func(c *gin.Context) { orderQueueGet(c, db, rdb) })
+		//user's wishlists
+		r.GET("/wishlists", authMW, func(c *gin.Context) { wishlistsGet(c, db, rdb) })
+		//new wishlist
+		r.POST("/wishlists", authMW, statusMW, func(c *gin.Context) { wishlistPost(c, db, rdb) })
+		//wishlist entries
+		r.GET("/wishlists/:id", authMW, func(c *gin.Context) { wishlistGet(c, db, rdb) })
+		//rename wishlist or change its sharing
+		r.PATCH("/wishlists/:id", authMW, statusMW, func(c *gin.Context) { wishlistPatch(c, db, rdb) })
+		//wishlist deletion
+		r.DELETE("/wishlists/:id", authMW, statusMW, func(c *gin.Context) { wishlistDelete(c, db, rdb) })
+		//save product to wishlist
+		r.POST("/wishlists/:id/items", authMW, statusMW, func(c *gin.Context) { wishlistItemPost(c, db, rdb) })
+		//remove product from wishlist
+		r.DELETE("/wishlists/:id/items/:product", authMW, statusMW, func(c *gin.Context) { wishlistItemDelete(c, db, rdb) })
+		//shared wishlist by link
+		r.GET("/shared/wishlists/:token", func(c *gin.Context) { wishlistSharedGet(c, db, rdb) })
+		//client reported events such as cart adds
+		r.POST("/events", optAuthMW, func(c *gin.Context) { eventPost(c, db, rdb, events) })
+		//recorded events for moderators
+		r.GET("/events", authMW, statusMW, can(permEvents), func(c *gin.Context) { eventGet(c, db, rdb) })
+		//current economy metrics
+		r.GET("/economy", func(c *gin.Context) { economyGet(c, db, rdb) })
+		//economy time series
+		r.GET("/economy/history", func(c *gin.Context) { economyHistoryGet(c, db, rdb) })
+		//average price, listings and stock per department over time
+		r.GET("/economy/departments", func(c *gin.Context) { economyDepartmentsGet(c, db, rdb) })
+		//account creation
+		r.POST("/signup", func(c *gin.Context) { signup(c, provider, db, rdb) })
+	}
+	routes(app)
+	routes(app.Group("/worlds/:world"))
+	//worlds
+	app.GET("/worlds", func(c *gin.Context) { worldsGet(c, db, rdb) })
+	//new empty world
+	app.POST("/worlds", globalMW, authMW, statusMW, can(permWorlds), func(c *gin.Context) { worldPost(c, db, rdb) })
+	//copy of a world's users, cards, listings and orders
+	app.POST("/worlds/:world/clone", globalMW, authMW, statusMW, can(permWorlds), func(c *gin.Context) { worldClonePost(c, db, rdb) })
+	//process is up
+	app.GET("/healthz", healthGet)
+	//Postgres, Redis and Firebase are reachable
+	app.GET("/readyz", func(c *gin.Context) { readyGet(c, provider, db, rdb) })
+	//pools, cache hit rates, breakers and build version
+	app.GET("/admin/status", globalMW, authMW, statusMW, can(permStatus), func(c *gin.Context) { statusGet(c, provider, db, rdb) })
+	//simulation time
+	app.GET("/clock", func(c *gin.Context) { clockGet(c, db, rdb) })
+	//switch between real, accelerated and frozen time
+	app.PUT("/clock", globalMW, authMW, statusMW, can(permClock), func(c *gin.Context) { clockPut(c, db, rdb) })
+	//step simulation time forward
+	app.POST("/clock/advance", globalMW, authMW, statusMW, can(permClock), func(c *gin.Context) { clockAdvancePost(c, db, rdb) })
+	//saved snapshots of the simulation state
+	app.GET("/admin/snapshots", globalMW, authMW, statusMW, can(permSnapshots), func(c *gin.Context) { snapshotsGet(c, db, rdb) })
+	//snapshot the current state
+	app.POST("/admin/snapshots", globalMW, authMW, statusMW, can(permSnapshots), func(c *gin.Context) { snapshotPost(c, db, rdb) })
+	//replace the current state with a snapshot
+	app.POST("/admin/snapshots/:name/restore", globalMW, authMW, statusMW, can(permSnapshots), func(c *gin.Context) { snapshotRestorePost(c, db, rdb) })
+	//privileged actions of moderators, admins and jobs
+	app.GET("/admin/audit", globalMW, authMW, statusMW, can(permAudit), func(c *gin.Context) { auditGet(c, db, rdb) })
+	//empty or seeded database, every world included
+	app.POST("/admin/reset", globalMW, authMW, statusMW, can(permSnapshots), func(c *gin.Context) { resetPost(c, db, rdb) })
+	served := serve(newServer(app))
+	if served != nil {
+		log.Printf("server stopped: %v", served)
+	}
+	jobs.stop()
+	stopRecording()
+	<-events.done
+	db.Close()
+	rdb.Close()
+	log.Printf("shut down")
+	//supervisors restart on a non-zero exit, a signal is a clean stop
+	if served != nil {
+		os.Exit(1)
 	}
 }
 
-func authenticate(c *gin.Context, fba *auth.Client, opt bool, db *sql.DB, rdb *redis.Client) {
-	idToken := c.GetHeader("Authorization")
-	token, err := fba.VerifyIDToken(context.Background(), idToken)
+func connect() (*sql.DB, *redis.Client) {
+	opt, err := redis.ParseURL(settings.Stores.RedisURL)
+	if err != nil {
+		panic("redis connection failed")
+	}
+	rdb := redis.NewClient(opt)
+	db, err := sql.Open("postgres", settings.Stores.PostgresURL)
+	if err != nil {
+		panic("postgres connection failed")
+	}
+	//a wrong URL fails here instead of on the first request
+	if err := waitFor("postgres", db.PingContext); err != nil {
+		panic("postgres connection failed: " + err.Error())
+	}
+	if err := waitFor("redis", func(ctx context.Context) error { return rdb.Ping(ctx).Err() }); err != nil {
+		panic("redis connection failed: " + err.Error())
+	}
+	rdb.AddHook(breakerHook{redisBreaker})
+	if err := migrate(db); err != nil {
+		panic("postgres migration failed")
+	}
+	return db, rdb
+}
+
+func authenticate(c *gin.Context, provider AuthProvider, opt bool, db *sql.DB, rdb *redis.Client) {
+	idToken := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	uid, err := provider.Verify(context.Background(), idToken)
 	if err != nil {
 		if opt {
 			c.Next()
 			return
 		}
-		c.Status(http.StatusUnauthorized)
-		c.Abort()
-		return
-	}
-	if id, err := rdb.Get(context.Background(), token.UID).Result(); err == nil {
-		c.Set("UID", id)
-	} else if err := db.QueryRow("SELECT id FROM Firebase WHERE uid = '" + token.UID + "';").Scan(&id); err == nil {
-		c.Set("UID", id)
-		rdb.Set(context.Background(), token.UID, id, 0)
-	} else {
-		c.Status(http.StatusInternalServerError)
+		if !unavailable(c, firebaseBreaker, err) {
+			fail(c, http.StatusUnauthorized, err)
+		}
 		c.Abort()
 		return
 	}
-
-	c.Next()
-}
-
-func DEVELOPMENT_ONLY_AUTHENTICATION_TEST(c *gin.Context, opt bool) {
-	idToken := c.GetHeader("Authorization")
-	var token auth.Token
-	switch idToken {
-	case "token1":
-		token.UID = "1"
-	case "token2":
-		token.UID = "2"
-	case "modtoken":
-		token.UID = "3"
-	default:
+	//the same account may be registered in several worlds
+	world := worldOf(c)
+	id, err := cache.Fetch(c.Request.Context(), rdb, uidCache, world+":"+uid, func() (string, error) {
+		var id string
+		err := db.QueryRow("SELECT id FROM Firebase WHERE uid = $1 AND world_id = $2;", uid, world).Scan(&id)
+		return id, err
+	})
+	if err == nil {
+		c.Set(userKey, id)
+	} else if err == sql.ErrNoRows {
 		if opt {
 			c.Next()
 			return
@@ -144,29 +299,34 @@ func DEVELOPMENT_ONLY_AUTHENTICATION_TEST(c *gin.Context, opt bool) {
 		c.Status(http.StatusUnauthorized)
 		c.Abort()
 		return
+	} else {
+		//Postgres is unreachable and the account is not cached
+		c.Status(http.StatusServiceUnavailable)
+		c.Abort()
+		return
 	}
-	c.Set("uid", token.UID)
+
 	c.Next()
 }
 
 func checkStatus(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	id, exists := c.Get("uid")
+	id, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		c.Abort()
 		return
 	}
-	var status string
-	if status, err := rdb.HGet(context.Background(), id.(string), "status").Result(); err == nil {
-		c.Set("status", status)
-	} else if err := db.QueryRow("SELECT status FROM Users WHERE id = " + id.(string) + ";").Scan(&status); err == nil {
-		c.Set("status", status)
-		rdb.HSet(context.Background(), id.(string), map[string]string{"status": status})
-	} else {
-		c.Status(http.StatusInternalServerError)
+	status, err := cache.Fetch(c.Request.Context(), rdb, statusCache, id.(string), func() (string, error) {
+		var status string
+		err := db.QueryRow("SELECT status FROM Users WHERE id = $1;", id.(string)).Scan(&status)
+		return status, err
+	})
+	if err != nil {
+		fail(c, http.StatusServiceUnavailable, err)
 		c.Abort()
 		return
 	}
+	c.Set("status", status)
 	if status == "B" {
 		c.Status(http.StatusUnauthorized)
 		c.Abort()
@@ -175,7 +335,8 @@ func checkStatus(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	c.Next()
 }
 
-func signup(c *gin.Context, fba *auth.Client, db *sql.DB, rdb *redis.Client) {
+// Firebase accounts are created here, with local tokens the account is the uid of the token sent along
+func signup(c *gin.Context, provider AuthProvider, db *sql.DB, rdb *redis.Client) {
 	var credentials struct {
 		Email    string `json:"email" binding:"required,email"`
 		Password string `json:"password" binding:"required"`
@@ -187,35 +348,32 @@ func signup(c *gin.Context, fba *auth.Client, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 	var uid string
-	if user, err := fba.GetUserByEmail(context.Background(), credentials.Email); err == nil && user != nil && user.UserInfo != nil {
-		uid = user.UserInfo.UID
-	} else {
-		params := (&auth.UserToCreate{}).
-			Email(credentials.Email).
-			EmailVerified(false).
-			Password(credentials.Password).
-			DisplayName(credentials.Name).
-			Disabled(false)
-		if credentials.Phone != "" {
-			params = params.PhoneNumber(credentials.Phone)
-		}
-		user, err := fba.CreateUser(context.Background(), params)
+	var err error
+	if accounts, ok := provider.(accountProvider); ok {
+		uid, err = accounts.Account(context.Background(), credentials.Email, credentials.Password, credentials.Name, credentials.Phone)
 		if err != nil {
-			c.Status(http.StatusInternalServerError)
+			fail(c, http.StatusInternalServerError, err)
 			return
 		}
-		uid = user.UID
+	} else if uid, err = provider.Verify(context.Background(), strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")); err != nil {
+		fail(c, http.StatusUnauthorized, err)
+		return
 	}
 	var id string
-	err := db.QueryRow("INSERT INTO Users(name, email, status, created) VALUES('" +
-		credentials.Name + "', '" + credentials.Email + "', 'A', NOW()) RETURNING id;").Scan(&id)
+	world := worldOf(c)
+	err = db.QueryRow("INSERT INTO Users(name, email, status, created, world_id) VALUES($1, $2, 'A', $3, $4) RETURNING id;",
+		credentials.Name, credentials.Email, clock.Now(), world).Scan(&id)
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
-	_, err = db.Query("INSERT INTO Firebase(uid, id) VALUES('" + uid + "', " + id + ");")
+	_, err = db.Exec("INSERT INTO Firebase(uid, id, world_id) VALUES($1, $2, $3);", uid, id, world)
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := db.Exec(defaultRolesQuery, id, clock.Now()); err != nil {
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
 	c.Status(http.StatusCreated)
@@ -231,43 +389,51 @@ func userGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	var user struct {
+	type profile struct {
 		Email   string `json:"email"`
 		Name    string `json:"name"`
 		Address string `json:"address"`
 	}
-	err := db.QueryRow("SELECT email, COALESCE(name, '') AS name, COALESCE(address, '') AS address FROM Users WHERE id = "+
-		id+";").Scan(&user.Email, &user.Name, &user.Address)
+	user, err := cache.Fetch(c.Request.Context(), rdb, userCache, worldOf(c)+":"+id, func() (profile, error) {
+		var user profile
+		err := db.QueryRow("SELECT email, COALESCE(name, '') AS name, COALESCE(address, '') AS address FROM Users WHERE id::text = $1"+
+			" AND world_id = $2;", id, worldOf(c)).Scan(&user.Email, &user.Name, &user.Address)
+		return user, err
+	})
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	c.IndentedJSON(http.StatusOK, user)
 }
 
 func userPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	status, exists := c.Get("status")
-	if !exists || status != "M" {
-		c.Status(http.StatusUnauthorized)
-		return
-	}
-
 	id, exists := c.Params.Get("id")
 	if !exists {
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
-	if _, err := db.Query("UPDATE Users SET status = 'A' WHERE id = " + id + ";"); err != nil {
-		c.Status(http.StatusInternalServerError)
+	var found bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE id::text = $1 AND world_id = $2);", id, worldOf(c)).Scan(&found); err != nil || !found {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	moderator, _ := c.Get(userKey)
+	lifted, err := liftBan(c.Request.Context(), db, rdb, id, moderator.(string), clock.Now())
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !lifted {
+		c.Status(http.StatusNotFound)
 		return
 	}
-	rdb.HSet(context.Background(), id, map[string]string{"status": "A"})
 	c.Status(http.StatusOK)
 }
 
 func userPatch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	uid, exists := c.Get("uid")
+	uid, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -281,36 +447,58 @@ func userPatch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	if err := c.BindJSON(&user); err != nil {
 		return
 	}
-	if _, err := db.Query("UPDATE Users SET name = '" + user.Name + "', address = '" + user.Address + "' WHERE id = " + uid.(string) + ";"); err != nil {
-		c.Status(http.StatusInternalServerError)
+	if _, err := db.Exec("UPDATE Users SET name = $1, address = $2 WHERE id = $3 AND world_id = $4;", user.Name, user.Address, uid.(string), worldOf(c)); err != nil {
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
+	userCache.Delete(c.Request.Context(), rdb, worldOf(c)+":"+uid.(string))
 	c.Status(http.StatusOK)
 }
 
 func userDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	status, exists := c.Get("status")
-	if !exists || status != "M" {
-		c.Status(http.StatusUnauthorized)
-		return
-	}
-
 	id, exists := c.Params.Get("id")
 	if !exists {
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
-	if _, err := db.Query("UPDATE Users SET status = 'B' WHERE id = " + id + ";"); err != nil {
-		c.Status(http.StatusInternalServerError)
+	var ban struct {
+		Reason   string `json:"reason" binding:"required"`
+		Duration string `json:"duration"`
+	}
+	if err := c.BindJSON(&ban); err != nil {
+		return
+	}
+	//bans without a duration are permanent
+	var expires time.Time
+	if ban.Duration != "" {
+		d, err := time.ParseDuration(ban.Duration)
+		if err != nil || d <= 0 {
+			fail(c, http.StatusBadRequest, err)
+			return
+		}
+		expires = clock.Now().Add(d)
+	}
+	var found bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE id::text = $1 AND world_id = $2);", id, worldOf(c)).Scan(&found); err != nil || !found {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	moderator, _ := c.Get(userKey)
+	banned, err := banUser(c.Request.Context(), db, rdb, id, moderator.(string), ban.Reason, expires)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !banned {
+		c.Status(http.StatusConflict)
 		return
 	}
-	rdb.HSet(context.Background(), id, map[string]string{"status": "B"})
 	c.Status(http.StatusOK)
 }
 
 func cardGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	uid, exists := c.Get("uid")
+	uid, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -321,11 +509,11 @@ func cardGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		Balance string `json:"balance"`
 	}
 
-	rows, err := db.Query("SELECT Cards.number AS number, Cards.balance AS balance FROM Users JOIN Cards" +
-		" ON Users.id = Cards.user_id WHERE Users.id = " + uid.(string) + " GROUP BY Cards.number, Cards.balance;")
+	rows, err := db.Query("SELECT Cards.number AS number, Cards.balance AS balance FROM Users JOIN Cards"+
+		" ON Users.id = Cards.user_id WHERE Users.id = $1 AND Cards.world_id = $2 GROUP BY Cards.number, Cards.balance;", uid.(string), worldOf(c))
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	for rows.Next() {
@@ -334,7 +522,7 @@ func cardGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 			Balance string `json:"balance"`
 		}
 		if err := rows.Scan(&card.Number, &card.Balance); err != nil {
-			c.Status(http.StatusInternalServerError)
+			fail(c, http.StatusInternalServerError, err)
 			return
 		}
 		cards = append(cards, card)
@@ -343,7 +531,7 @@ func cardGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 }
 
 func cardPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	uid, exists := c.Get("uid")
+	uid, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -357,65 +545,83 @@ func cardPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 
-	_, err := db.Query("INSERT INTO Cards(user_id, number, code, balance, created) VALUES(" +
-		uid.(string) + ",'" + card.Number + "', '" + card.Code + "', 0, NOW());")
+	_, err := db.Exec("INSERT INTO Cards(user_id, number, code, balance, created, world_id) VALUES($1, $2, $3, 0, $4, $5);",
+		uid.(string), card.Number, card.Code, clock.Now(), worldOf(c))
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	c.Status(http.StatusCreated)
 }
 
-func productSearch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	search := ""
+func productSearch(c *gin.Context, db *sql.DB, rdb *redis.Client, events *eventRecorder) {
 	sort := c.Query("sort")
-	if sort == "" {
+	switch sort {
+	case "":
 		sort = "created"
+	case "created", "name", "department", "quantity", "price":
+	default:
+		c.Status(http.StatusBadRequest)
+		return
 	}
 	sortType := " DESC"
 	if c.Query("sortType") == "1" {
 		sortType = " ASC"
 	}
+	search := ""
+	args := []any{worldOf(c)}
 	for _, term := range [...]string{"name", "description", "department"} {
 		value := c.Query(term)
 		if value != "" {
-			search += " AND " + term + " LIKE '%" + value + "%'"
+			args = append(args, "%"+value+"%")
+			search += " AND " + term + " LIKE $" + strconv.Itoa(len(args))
 		}
 	}
 
-	var products []struct {
+	type listing struct {
+		Id          string `json:"id"`
 		Name        string `json:"name"`
 		Description string `json:"description"`
 		Department  string `json:"department"`
 		Quantity    string `json:"quantity"`
 		Price       string `json:"price"`
 	}
-
-	rows, err := db.Query("SELECT name, description, department, quantity, price FROM Products" +
-		" WHERE status = 'A'" + search + " ORDER BY " + sort + sortType + " LIMIT 50;")
+	//repeated searches are served from the cache until a listing of the world changes
+	query := sha1.Sum([]byte(fmt.Sprint(search, args, " ORDER BY ", sort, sortType)))
+	key := worldOf(c) + ":" + searchCache.Version(c.Request.Context(), rdb, worldOf(c)) + ":" + hex.EncodeToString(query[:])
+	products, err := cache.Fetch(c.Request.Context(), rdb, searchCache, key, func() ([]listing, error) {
+		var products []listing
+		rows, err := db.Query("SELECT id, name, description, department, quantity, price FROM Products"+
+			" WHERE status = 'A' AND world_id = $1"+search+activeSeller+" ORDER BY "+sort+sortType+" LIMIT 50;", args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var product listing
+			if err := rows.Scan(&product.Id, &product.Name, &product.Description, &product.Department, &product.Quantity, &product.Price); err != nil {
+				return nil, err
+			}
+			products = append(products, product)
+		}
+		return products, rows.Err()
+	})
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
-	for rows.Next() {
-		var product struct {
-			Name        string `json:"name"`
-			Description string `json:"description"`
-			Department  string `json:"department"`
-			Quantity    string `json:"quantity"`
-			Price       string `json:"price"`
-		}
-		if err := rows.Scan(&product.Name, &product.Description, &product.Department, &product.Quantity, &product.Price); err != nil {
-			c.Status(http.StatusInternalServerError)
-			return
+	var terms []string
+	for _, term := range [...]string{"name", "description", "department"} {
+		if value := c.Query(term); value != "" {
+			terms = append(terms, term+":"+value)
 		}
-		products = append(products, product)
 	}
+	events.record(event{Kind: eventSearch, World: worldOf(c), User: eventUser(c), Query: strings.Join(terms, " "), Results: len(products)})
 	c.IndentedJSON(http.StatusOK, gin.H{"products": products})
 }
 
-func productGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	var product struct {
+func productGet(c *gin.Context, db *sql.DB, rdb *redis.Client, events *eventRecorder) {
+	type details struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
 		Department  string `json:"department"`
@@ -427,15 +633,25 @@ func productGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	var cardId string
-	var status string
-	err := db.QueryRow("SELECT card_id, name, description, department, quantity, price, status FROM Products WHERE id = "+id+
-		";").Scan(&cardId, &product.Name, &product.Description, &product.Department, &product.Quantity, &product.Price, &status)
-	if err != nil || status != "A" {
-		c.Status(http.StatusNotFound)
+	//the world, card and status are cached along so hidden listings stay hidden
+	type listing struct {
+		World, Card, Status string
+		Product             details
+	}
+	cached, err := cache.Fetch(c.Request.Context(), rdb, productCache, id, func() (listing, error) {
+		var row listing
+		err := db.QueryRow("SELECT world_id, card_id, name, description, department, quantity, price, status FROM Products WHERE id::text = $1;", id).
+			Scan(&row.World, &row.Card, &row.Product.Name, &row.Product.Description, &row.Product.Department, &row.Product.Quantity, &row.Product.Price, &row.Status)
+		return row, err
+	})
+	product, cardId := cached.Product, cached.Card
+	if err != nil || cached.Status != "A" || cached.World != worldOf(c) {
+		fail(c, http.StatusNotFound, err)
 		return
 	}
-	_, exists := c.Get("uid")
+	events.record(event{Kind: eventView, World: worldOf(c), User: eventUser(c), Product: id})
+	trendingRecord(c.Request.Context(), rdb, worldOf(c), id, trendingViewScore)
+	_, exists := c.Get(userKey)
 	if !exists {
 		c.IndentedJSON(http.StatusOK, gin.H{"product": product})
 		return
@@ -445,7 +661,7 @@ func productGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		Email string `json:"email"`
 	}
 	err = db.QueryRow("SELECT Users.name AS name, Users.email AS email FROM Users JOIN Cards"+
-		" ON Users.id = Cards.user_id WHERE Cards.id ="+cardId+"").Scan(&seller.Name, &seller.Email)
+		" ON Users.id = Cards.user_id WHERE Cards.id = $1 AND Cards.world_id = $2;", cardId, worldOf(c)).Scan(&seller.Name, &seller.Email)
 	if err != nil {
 		c.IndentedJSON(http.StatusOK, gin.H{"product": product})
 		return
@@ -454,7 +670,7 @@ func productGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 }
 
 func productPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	id, exists := c.Get("uid")
+	id, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -474,11 +690,12 @@ func productPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	}
 	var cardId string
 	var code string
-	cardErr := db.QueryRow("SELECT id, code FROM Cards WHERE user_id = "+
-		id.(string)+" AND number = '"+product.Card+"';").Scan(&cardId, &code)
+	cardErr := db.QueryRow("SELECT id, code FROM Cards WHERE user_id = $1 AND number = $2 AND world_id = $3;",
+		id.(string), product.Card, worldOf(c)).Scan(&cardId, &code)
 
 	if cardErr != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, cardErr)
+		return
 	}
 	if code != product.Code {
 		c.Status(http.StatusUnauthorized)
@@ -487,21 +704,23 @@ func productPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 
 	quantity, qErr := strconv.ParseInt(product.Quantity, 10, 16)
 	if qErr != nil || quantity < 1 {
-		c.Status(http.StatusBadRequest)
+		fail(c, http.StatusBadRequest, qErr)
 		return
 	}
 
-	_, err := db.Query("INSERT INTO Products(card_id, name, description, department, quantity, price, status, created) VALUES('" +
-		cardId + "','" + product.Name + "', '" + product.Description + "', '" + product.Department + "', " + product.Quantity + ", " + product.Price + ", 'A', NOW());")
+	_, err := db.Exec("INSERT INTO Products(card_id, name, description, department, quantity, price, status, created, world_id)"+
+		" VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9);", cardId, product.Name, product.Description, product.Department, product.Quantity,
+		product.Price, listingStatus(), clock.Now(), worldOf(c))
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
+	searchCache.Invalidate(c.Request.Context(), rdb, worldOf(c))
 	c.Status(http.StatusCreated)
 }
 
 func productPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	id, exists := c.Get("uid")
+	id, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -519,11 +738,11 @@ func productPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 	var code string
-	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id" +
-		" WHERE Cards.user_id = " + id.(string) + " AND Products.id = " + productId + ";").Scan(&code)
+	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1 AND Products.id::text = $2 AND Products.world_id = $3;", id.(string), productId, worldOf(c)).Scan(&code)
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	if code != product.Code {
@@ -531,16 +750,22 @@ func productPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 
-	_, err = db.Query("UPDATE Products SET status = 'A' WHERE id = " + productId + ";")
+	//pending and taken down listings are up to moderators
+	result, err := db.Exec("UPDATE Products SET status = 'A' WHERE id = $1 AND status IN ('A', 'R');", productId)
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusConflict, err)
 		return
 	}
+	invalidateProducts(c.Request.Context(), rdb, worldOf(c), productId)
 	c.Status(http.StatusOK)
 }
 
 func productPatch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	id, exists := c.Get("uid")
+	id, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -559,11 +784,11 @@ func productPatch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 	var code string
-	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id" +
-		" WHERE Cards.user_id = " + id.(string) + " AND Products.id = " + productId + ";").Scan(&code)
+	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1 AND Products.id::text = $2 AND Products.world_id = $3;", id.(string), productId, worldOf(c)).Scan(&code)
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	if code != product.Code {
@@ -572,20 +797,21 @@ func productPatch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	}
 
 	if quantity, err := strconv.ParseInt(product.Quantity, 10, 16); err != nil || quantity < 0 {
-		c.Status(http.StatusBadRequest)
+		fail(c, http.StatusBadRequest, err)
 		return
 	}
 
-	_, err = db.Query("UPDATE Products SET quantity = " + product.Quantity + " WHERE id = " + productId + ";")
+	_, err = db.Exec("UPDATE Products SET quantity = $1 WHERE id = $2;", product.Quantity, productId)
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
+	invalidateProducts(c.Request.Context(), rdb, worldOf(c), productId)
 	c.Status(http.StatusOK)
 }
 
 func productDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	id, exists := c.Get("uid")
+	id, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -603,11 +829,11 @@ func productDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 	var code string
-	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id" +
-		" WHERE Cards.user_id = " + id.(string) + " AND Products.id = " + productId + ";").Scan(&code)
+	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1 AND Products.id::text = $2 AND Products.world_id = $3;", id.(string), productId, worldOf(c)).Scan(&code)
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	if code != product.Code {
@@ -615,20 +841,36 @@ func productDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 
-	_, err = db.Query("UPDATE Products SET status = 'R' WHERE id = " + productId + ";")
+	result, err := db.Exec("UPDATE Products SET status = 'R' WHERE id = $1 AND status IN ('A', 'R');", productId)
 	if err != nil {
-		c.Status(http.StatusInternalServerError)
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusConflict, err)
+		return
+	}
+	invalidateProducts(c.Request.Context(), rdb, worldOf(c), productId)
 	c.Status(http.StatusOK)
 }
 
+// seller's public answer to a review
+type reviewReply struct {
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+	Edited    string `json:"edited,omitempty"`
+}
+
 func reviewGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	var reviews []struct {
-		Name      string `json:"name"`
-		Text      string `json:"text"`
-		Rating    string `json:"rating"`
-		Timestamp string `json:"timestamp"`
+		Id        string       `json:"id"`
+		Name      string       `json:"name"`
+		Text      string       `json:"text"`
+		Rating    string       `json:"rating"`
+		Helpful   string       `json:"helpful"`
+		Unhelpful string       `json:"unhelpful"`
+		Timestamp string       `json:"timestamp"`
+		Reply     *reviewReply `json:"reply"`
 	}
 
 	id, hasId := c.Params.Get("id")
@@ -637,32 +879,76 @@ func reviewGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		return
 	}
 
-	rows, err := db.Query("SELECT Reviews.review AS text, Users.name AS name, Reviews.created AS timestamp," +
-		" Reviews.rating AS rating FROM Reviews JOIN Users ON Users.id = Reviews.user_id WHERE Reviews.product_id" +
-		" = " + id + " ORDER BY Reviews.created DESC;")
+	order := "Reviews.created DESC"
+	switch c.Query("sort") {
+	case "", "recent":
+	case "helpful":
+		order = "COALESCE(v.helpful, 0) - COALESCE(v.unhelpful, 0) DESC, COALESCE(v.helpful, 0) DESC, Reviews.created DESC"
+	case "highest":
+		order = "Reviews.rating DESC, Reviews.created DESC"
+	case "lowest":
+		order = "Reviews.rating ASC, Reviews.created DESC"
+	default:
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	filter := ""
+	args := []any{id, worldOf(c)}
+	if value := c.Query("rating"); value != "" {
+		rating, err := strconv.ParseInt(value, 10, 16)
+		if err != nil || rating > 5 || rating < 1 {
+			fail(c, http.StatusBadRequest, err)
+			return
+		}
+		args = append(args, rating)
+		filter = " AND Reviews.rating = $3"
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query("SELECT Reviews.id, Reviews.review AS text, Users.name AS name, Reviews.created AS timestamp,"+
+		" Reviews.rating AS rating, COALESCE(v.helpful, 0), COALESCE(v.unhelpful, 0), ReviewReplies.reply, ReviewReplies.created,"+
+		" ReviewReplies.edited FROM Reviews JOIN Users ON Users.id = Reviews.user_id"+
+		" LEFT JOIN (SELECT review_id, COUNT(*) FILTER (WHERE helpful) AS helpful, COUNT(*) FILTER (WHERE NOT helpful) AS unhelpful"+
+		" FROM ReviewVotes GROUP BY review_id) AS v ON v.review_id = Reviews.id LEFT JOIN ReviewReplies ON ReviewReplies.review_id = Reviews.id"+
+		" WHERE Reviews.product_id = $1 AND Users.world_id = $2"+filter+
+		" ORDER BY "+order+" LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", args...)
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var review struct {
-			Name      string `json:"name"`
-			Text      string `json:"text"`
-			Rating    string `json:"rating"`
-			Timestamp string `json:"timestamp"`
+			Id        string       `json:"id"`
+			Name      string       `json:"name"`
+			Text      string       `json:"text"`
+			Rating    string       `json:"rating"`
+			Helpful   string       `json:"helpful"`
+			Unhelpful string       `json:"unhelpful"`
+			Timestamp string       `json:"timestamp"`
+			Reply     *reviewReply `json:"reply"`
 		}
-		if err := rows.Scan(&review.Text, &review.Name, &review.Timestamp, &review.Rating); err != nil {
-			c.Status(http.StatusInternalServerError)
+		var replyText, replyTimestamp, replyEdited sql.NullString
+		if err := rows.Scan(&review.Id, &review.Text, &review.Name, &review.Timestamp, &review.Rating, &review.Helpful, &review.Unhelpful,
+			&replyText, &replyTimestamp, &replyEdited); err != nil {
+			fail(c, http.StatusInternalServerError, err)
 			return
 		}
+		if replyText.Valid {
+			review.Reply = &reviewReply{Text: replyText.String, Timestamp: replyTimestamp.String, Edited: replyEdited.String}
+		}
 		reviews = append(reviews, review)
 	}
 	c.IndentedJSON(http.StatusOK, gin.H{"reviews": reviews})
 }
 
 func reviewPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	uid, exists := c.Get("uid")
+	uid, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -678,21 +964,126 @@ func reviewPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	}
 
 	if rating, err := strconv.ParseInt(review.Rating, 10, 16); err != nil || rating > 5 || rating < 1 {
-		c.Status(http.StatusBadRequest)
+		fail(c, http.StatusBadRequest, err)
 		return
 	}
 
-	_, err := db.Query("INSERT INTO Reviews(user_id, review, rating, product_id, created) VALUES(" +
-		uid.(string) + ", '" + review.Text + "', " + review.Rating + ", " + review.Product + ", NOW());")
+	result, err := db.Exec("INSERT INTO Reviews(user_id, review, rating, product_id, created) SELECT $1::integer, $2, $3::integer, id, $4"+
+		" FROM Products WHERE id::text = $5 AND world_id = $6;", uid.(string), review.Text, review.Rating, clock.Now(), review.Product, worldOf(c))
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	c.Status(http.StatusCreated)
 }
 
+func reviewVotePut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	reviewId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var vote struct {
+		Helpful *bool `json:"helpful" binding:"required"`
+	}
+	if err := c.BindJSON(&vote); err != nil {
+		return
+	}
+
+	//one vote per user per review, voting again replaces the previous vote
+	result, err := db.Exec("INSERT INTO ReviewVotes(review_id, user_id, helpful, created) SELECT Reviews.id, $2, $3, $4"+
+		" FROM Reviews JOIN Users ON Users.id = Reviews.user_id WHERE Reviews.id = $1 AND Users.world_id = $5"+
+		" ON CONFLICT (review_id, user_id) DO UPDATE SET helpful = EXCLUDED.helpful, created = EXCLUDED.created;",
+		reviewId, uid.(string), *vote.Helpful, clock.Now(), worldOf(c))
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func reviewVoteDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	reviewId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM ReviewVotes WHERE review_id = $1 AND user_id = $2;", reviewId, uid.(string))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func reviewReplyPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	id, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	reviewId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var reply struct {
+		Code string `json:"code" binding:"required,len=4"`
+		Text string `json:"text" binding:"required"`
+	}
+	if err := c.BindJSON(&reply); err != nil {
+		return
+	}
+	var code string
+	err := db.QueryRow("SELECT Cards.code FROM Reviews JOIN Products ON Reviews.product_id = Products.id JOIN Cards"+
+		" ON Products.card_id = Cards.id WHERE Cards.user_id = $1 AND Reviews.id = $2;", id.(string), reviewId).Scan(&code)
+
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if code != reply.Code {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO ReviewReplies(review_id, user_id, reply, created) VALUES($1, $2, $3, $4)"+
+		" ON CONFLICT (review_id) DO UPDATE SET reply = EXCLUDED.reply, edited = EXCLUDED.created;", reviewId, id.(string), reply.Text, clock.Now())
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
 func orderGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	uid, exists := c.Get("uid")
+	uid, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -707,12 +1098,12 @@ func orderGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		Timestamp string `json:"timestamp"`
 	}
 
-	rows, err := db.Query("SELECT Products.name, Cards.number, Orders.quantity, Products.price, Orders.status, Orders.created" +
-		" FROM Users JOIN Cards ON Users.id = Cards.user_id JOIN Orders ON Cards.id = Orders.card_id JOIN Products ON " +
-		" Products.id = Orders.product_id WHERE Users.id = " + uid.(string) + ";")
+	rows, err := db.Query("SELECT Products.name, Cards.number, Orders.quantity, COALESCE(Orders.price, Products.price), Orders.status, Orders.created"+
+		" FROM Users JOIN Cards ON Users.id = Cards.user_id JOIN Orders ON Cards.id = Orders.card_id JOIN Products ON "+
+		" Products.id = Orders.product_id WHERE Users.id = $1 AND Orders.world_id = $2;", uid.(string), worldOf(c))
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	for rows.Next() {
@@ -725,7 +1116,7 @@ func orderGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 			Timestamp string `json:"timestamp"`
 		}
 		if err := rows.Scan(&order.Name, &order.Card, &order.Quantity, &order.Price, &order.Status, &order.Timestamp); err != nil {
-			c.Status(http.StatusInternalServerError)
+			fail(c, http.StatusInternalServerError, err)
 			return
 		}
 		orders = append(orders, order)
@@ -734,7 +1125,7 @@ func orderGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 }
 
 func orderQueueGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	uid, exists := c.Get("uid")
+	uid, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -750,12 +1141,13 @@ func orderQueueGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 		Timestamp string `json:"timestamp"`
 	}
 
-	rows, err := db.Query("SELECT u1.name, Products.name, c0.number, Orders.quantity, Products.price, Orders.status, Orders.created" +
+	rows, err := db.Query("SELECT u1.name, Products.name, c0.number, Orders.quantity, COALESCE(Orders.price, Products.price), Orders.status, Orders.created" +
 		" FROM Users AS u0 JOIN Cards AS c0 ON u0.id = c0.user_id JOIN Products ON c0.id = Products.card_id JOIN Orders ON Products.id" +
-		" = Orders.product_id JOIN Cards AS c1 ON Orders.card_id = c1.id JOIN Users AS u1 ON c1.user_id = u1.id WHERE u0.id = " + uid.(string) + ";")
+		" = Orders.product_id JOIN Cards AS c1 ON Orders.card_id = c1.id JOIN Users AS u1 ON c1.user_id = u1.id WHERE u0.id = $1 AND Orders.world_id = $2;",
+		uid.(string), worldOf(c))
 
 	if err != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, err)
 		return
 	}
 	for rows.Next() {
@@ -769,7 +1161,7 @@ func orderQueueGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 			Timestamp string `json:"timestamp"`
 		}
 		if err := rows.Scan(&order.Buyer, &order.Name, &order.Card, &order.Quantity, &order.Price, &order.Status, &order.Timestamp); err != nil {
-			c.Status(http.StatusInternalServerError)
+			fail(c, http.StatusInternalServerError, err)
 			return
 		}
 		orders = append(orders, order)
@@ -777,8 +1169,8 @@ func orderQueueGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	c.IndentedJSON(http.StatusOK, gin.H{"orders": orders})
 }
 
-func orderPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
-	id, exists := c.Get("uid")
+func orderPost(c *gin.Context, db *sql.DB, rdb *redis.Client, events *eventRecorder) {
+	id, exists := c.Get(userKey)
 	if !exists {
 		c.Status(http.StatusUnauthorized)
 		return
@@ -793,15 +1185,22 @@ func orderPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	if err := c.BindJSON(&order); err != nil {
 		return
 	}
+	//the listing is locked so concurrent orders see each other's stock and price,
+	//the card is only debited while it still covers the cost
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
 	var cardId string
-	var card string
 	var code string
-	var balance string
-
-	cardErr := db.QueryRow("SELECT id, number, code, balance FROM Cards WHERE user_id = "+id.(string)+
-		" AND number = '"+order.Card+"';").Scan(&cardId, &card, &code, &balance)
+	cardErr := tx.QueryRowContext(ctx, "SELECT id, code FROM Cards WHERE user_id = $1 AND number = $2 AND world_id = $3;",
+		id.(string), order.Card, worldOf(c)).Scan(&cardId, &code)
 	if cardErr != nil {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, cardErr)
+		return
 	}
 	if code != order.Code {
 		c.Status(http.StatusUnauthorized)
@@ -811,33 +1210,73 @@ func orderPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
 	var qProd string
 	var price string
 	var status string
-	productErr := db.QueryRow("SELECT card_id, quantity, price, status FROM Products WHERE id = "+order.Product+";").Scan(&productCard, &qProd, &price, &status)
+	var department string
+	var seller string
+	productErr := tx.QueryRowContext(ctx, "SELECT Products.card_id, Products.quantity, Products.price, Products.status, Products.department, Cards.user_id"+
+		" FROM Products JOIN Cards ON Products.card_id = Cards.id WHERE Products.id::text = $1 AND Products.world_id = $2 FOR UPDATE OF Products;",
+		order.Product, worldOf(c)).Scan(&productCard, &qProd, &price, &status, &department, &seller)
 	if productErr != nil || status != "A" {
-		c.Status(http.StatusNotFound)
+		fail(c, http.StatusNotFound, productErr)
 		return
 	}
 	qOrder, qOrderErr := strconv.ParseInt(order.Quantity, 10, 16)
 	qProduct, qProductErr := strconv.ParseInt(qProd, 10, 16)
-	cardBalance, cardBalanceErr := strconv.ParseFloat(balance, 64)
 	pPrice, pPriceErr := strconv.ParseFloat(price, 64)
-	if qOrderErr != nil || qProductErr != nil || cardBalanceErr != nil || pPriceErr != nil || qProduct < qOrder {
-		c.Status(http.StatusBadRequest)
+	if qOrderErr != nil || qProductErr != nil || pPriceErr != nil || qOrder < 1 || qProduct < qOrder {
+		fail(c, http.StatusBadRequest, errors.Join(qOrderErr, qProductErr, pPriceErr))
 		return
 	}
 	cost := float64(qOrder) * pPrice
-	if cardBalance < cost {
-		c.Status(http.StatusPaymentRequired)
+	debited, err := tx.ExecContext(ctx, "UPDATE Cards SET balance = balance - $1 WHERE id = $2 AND balance >= $1;", cost, cardId)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
-	_, err := db.Query("INSERT INTO Orders(card_id, product_id, quantity, status, created) VALUES(" +
-		cardId + ", " + order.Product + ", " + order.Quantity + ", 'A', NOW()); UPDATE Cards SET" +
-		" balance = balance - " + strconv.FormatFloat(cost, 'f', -1, 64) + " WHERE id = " + cardId + ";" +
-		" UPDATE Products SET quantity = quantity - " + order.Quantity + " WHERE id = " + order.Product + ";" +
-		" UPDATE Cards SET balance = balance + " + strconv.FormatFloat(cost, 'f', -1, 64) + " WHERE" +
-		" id = " + productCard + ";")
-	if err != nil {
-		c.Status(http.StatusInternalServerError)
+	if n, err := debited.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusPaymentRequired, err)
+		return
+	}
+	for _, statement := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO Orders(card_id, product_id, quantity, price, status, created, world_id) VALUES($1, $2, $3, $4, 'A', $5, $6);",
+			[]any{cardId, order.Product, qOrder, pPrice, clock.Now(), worldOf(c)}},
+		{"UPDATE Products SET quantity = quantity - $1 WHERE id = $2;", []any{qOrder, order.Product}},
+		{"UPDATE Cards SET balance = balance + $1 WHERE id = $2;", []any{cost, productCard}},
+	} {
+		if _, err := tx.ExecContext(ctx, statement.query, statement.args...); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
 		return
 	}
+	events.record(event{Kind: eventPurchase, World: worldOf(c), User: id.(string), Product: order.Product, Quantity: int(qOrder)})
+	trendingRecord(c.Request.Context(), rdb, worldOf(c), order.Product, float64(trendingPurchaseScore*qOrder))
+	salesRecord(c.Request.Context(), rdb, worldOf(c), order.Product, department, seller, qOrder, cost)
+	invalidateProducts(c.Request.Context(), rdb, worldOf(c), order.Product)
 	c.Status(http.StatusCreated)
 }
+
+// reads the page and limit query parameters, pages start at 1
+func paginate(c *gin.Context) (limit int, offset int, ok bool) {
+	limit, page := 20, 1
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 50 {
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if value := c.Query("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, false
+		}
+		page = n
+	}
+	return limit, (page - 1) * limit, true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		query  string
+		limit  int
+		offset int
+		ok     bool
+	}{
+		{"", 20, 0, true},
+		{"?limit=5", 5, 0, true},
+		{"?page=3", 20, 40, true},
+		{"?limit=10&page=4", 10, 30, true},
+		{"?limit=50", 50, 0, true},
+		{"?limit=51", 0, 0, false},
+		{"?limit=0", 0, 0, false},
+		{"?page=0", 0, 0, false},
+		{"?page=-1", 0, 0, false},
+		{"?limit=ten", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/reviews"+test.query, nil)
+			limit, offset, ok := paginate(c)
+			if limit != test.limit || offset != test.offset || ok != test.ok {
+				t.Fatalf("got %d %d %v, want %d %d %v", limit, offset, ok, test.limit, test.offset, test.ok)
+			}
+		})
+	}
+}
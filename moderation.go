@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// product statuses besides 'A' active and 'R' removed by the seller
+const (
+	productPending   = "P"
+	productTakenDown = "T"
+)
+
+// moderator decisions on a listing, the status they apply to and the status they leave it in
+var moderationDecisions = map[string]struct {
+	from   string
+	to     string
+	action string
+}{
+	"approve":  {productPending, "A", auditProductApprove},
+	"reject":   {productPending, productTakenDown, auditProductReject},
+	"takedown": {"A", productTakenDown, auditProductTakedown},
+	"restore":  {productTakenDown, "A", auditProductRestore},
+}
+
+// status of new listings, pending review when listings.approval is set
+func listingStatus() string {
+	if settings.Listings.Approval {
+		return productPending
+	}
+	return "A"
+}
+
+// listings waiting for approval, oldest first, or taken down ones with ?status=T
+func moderationQueueGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	status := c.DefaultQuery("status", productPending)
+	if status != productPending && status != productTakenDown {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	type listing struct {
+		Id          string `json:"id"`
+		Seller      string `json:"seller"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Department  string `json:"department"`
+		Quantity    string `json:"quantity"`
+		Price       string `json:"price"`
+		Reason      string `json:"reason,omitempty"`
+		Moderator   string `json:"moderator,omitempty"`
+		Timestamp   string `json:"timestamp"`
+	}
+	var products []listing
+	rows, err := db.Query("SELECT Products.id, Cards.user_id, Products.name, Products.description, Products.department, Products.quantity,"+
+		" Products.price, COALESCE(Products.moderation_reason, ''), COALESCE(Products.moderator_id::text, ''), Products.created"+
+		" FROM Products JOIN Cards ON Cards.id = Products.card_id WHERE Products.status = $1 AND Products.world_id = $2"+
+		" ORDER BY Products.created, Products.id LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", status, worldOf(c))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var product listing
+		if err := rows.Scan(&product.Id, &product.Seller, &product.Name, &product.Description, &product.Department, &product.Quantity,
+			&product.Price, &product.Reason, &product.Moderator, &product.Timestamp); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		products = append(products, product)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"products": products})
+}
+
+// approve or reject a pending listing, take down an active one or restore a taken down one, rejections and takedowns need a reason
+func productModerationPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	moderator, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	id, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var moderation struct {
+		Decision string `json:"decision" binding:"required"`
+		Reason   string `json:"reason"`
+	}
+	if err := c.BindJSON(&moderation); err != nil {
+		return
+	}
+	decision, known := moderationDecisions[moderation.Decision]
+	if !known || (decision.to == productTakenDown && moderation.Reason == "") {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM Products WHERE id::text = $1 AND world_id = $2 FOR UPDATE;", id, worldOf(c)).Scan(&status)
+	if err == sql.ErrNoRows {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if status != decision.from {
+		c.Status(http.StatusConflict)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE Products SET status = $1, moderation_reason = $2, moderator_id = $3, moderated = $4 WHERE id::text = $5;",
+		decision.to, nullable(moderation.Reason), moderator.(string), clock.Now(), id); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := audit(ctx, tx, worldOf(c), moderator.(string), decision.action, "product", id, map[string]any{"status": status},
+		map[string]any{"status": decision.to, "reason": moderation.Reason}); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	invalidateProducts(ctx, rdb, worldOf(c), id)
+	c.Status(http.StatusOK)
+}
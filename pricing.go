@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+type pricingRule struct {
+	DemandStep          float64 `json:"demandStep" binding:"gte=0,lte=1"`
+	DemandThreshold     int     `json:"demandThreshold" binding:"gte=0"`
+	DemandWindowHours   int     `json:"demandWindowHours" binding:"gte=0"`
+	ClearanceStep       float64 `json:"clearanceStep" binding:"gte=0,lt=1"`
+	ClearanceAfterHours int     `json:"clearanceAfterHours" binding:"gte=0"`
+	Floor               float64 `json:"floor" binding:"gte=0"`
+	Ceiling             float64 `json:"ceiling" binding:"gte=0"`
+	Enabled             *bool   `json:"enabled"` //true when left out
+}
+
+// columns of a stored rule, in the order of fields
+const pricingColumns = "demand_step, demand_threshold, demand_window_hours, clearance_step, clearance_after_hours, floor, ceiling, enabled"
+
+func (rule *pricingRule) fields() []any {
+	return []any{&rule.DemandStep, &rule.DemandThreshold, &rule.DemandWindowHours, &rule.ClearanceStep, &rule.ClearanceAfterHours,
+		&rule.Floor, &rule.Ceiling, &rule.Enabled}
+}
+
+// new price for a product under rule, and the reason for the change
+//
+// demand: at least DemandThreshold units sold in the last DemandWindowHours raises the price by DemandStep,
+// at most once per window. clearance: stock that has not sold for ClearanceAfterHours since the last sale or
+// price change is discounted by ClearanceStep. the result is kept between Floor and Ceiling when they are set.
+func evaluatePricing(rule pricingRule, price float64, sold int, lastDemand time.Time, idleSince time.Time, quantity int, now time.Time) (float64, string) {
+	next, reason := price, ""
+	window := time.Duration(rule.DemandWindowHours) * time.Hour
+	if rule.DemandStep > 0 && rule.DemandThreshold > 0 && window > 0 && sold >= rule.DemandThreshold && now.Sub(lastDemand) >= window {
+		next, reason = price*(1+rule.DemandStep), "demand"
+	} else if rule.ClearanceStep > 0 && rule.ClearanceAfterHours > 0 && quantity > 0 &&
+		now.Sub(idleSince) >= time.Duration(rule.ClearanceAfterHours)*time.Hour {
+		next, reason = price*(1-rule.ClearanceStep), "clearance"
+	}
+	if rule.Floor > 0 && next < rule.Floor {
+		next, reason = rule.Floor, "floor"
+	}
+	if rule.Ceiling > 0 && next > rule.Ceiling {
+		next, reason = rule.Ceiling, "ceiling"
+	}
+	next = math.Round(next*100) / 100
+	if next == price {
+		return price, ""
+	}
+	return next, reason
+}
+
+// evaluates every enabled rule each jobs.pricingInterval (a minute by default) until ctx is cancelled
+func runPricing(ctx context.Context, db *sql.DB, rdb *redis.Client) {
+	ticker := time.NewTicker(settings.Jobs.PricingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := applyPricing(ctx, db, rdb); err != nil {
+				log.Printf("pricing rules failed: %v", err)
+			}
+		}
+	}
+}
+
+func applyPricing(ctx context.Context, db *sql.DB, rdb *redis.Client) error {
+	now := clock.Now()
+	rows, err := db.QueryContext(ctx, "SELECT PricingRules.product_id, demand_step, demand_threshold, demand_window_hours,"+
+		" clearance_step, clearance_after_hours, floor, ceiling, Products.price, Products.quantity,"+
+		" (SELECT COALESCE(SUM(quantity), 0) FROM Orders WHERE product_id = Products.id"+
+		" AND created > $1::timestamp - make_interval(hours => demand_window_hours)),"+
+		" (SELECT COALESCE(MAX(created), 'epoch') FROM PriceChanges WHERE product_id = Products.id AND reason = 'demand'),"+
+		" GREATEST(Products.created, (SELECT COALESCE(MAX(created), 'epoch') FROM Orders WHERE product_id = Products.id),"+
+		" (SELECT COALESCE(MAX(created), 'epoch') FROM PriceChanges WHERE product_id = Products.id))"+
+		" FROM PricingRules JOIN Products ON Products.id = PricingRules.product_id WHERE PricingRules.enabled AND Products.status = 'A';", now)
+	if err != nil {
+		return err
+	}
+	type change struct {
+		product string
+		price   float64
+		next    float64
+		reason  string
+	}
+	var changes []change
+	for rows.Next() {
+		var rule pricingRule
+		var product string
+		var price float64
+		var quantity, sold int
+		var lastDemand, idleSince time.Time
+		if err := rows.Scan(&product, &rule.DemandStep, &rule.DemandThreshold, &rule.DemandWindowHours, &rule.ClearanceStep,
+			&rule.ClearanceAfterHours, &rule.Floor, &rule.Ceiling, &price, &quantity, &sold, &lastDemand, &idleSince); err != nil {
+			rows.Close()
+			return err
+		}
+		if next, reason := evaluatePricing(rule, price, sold, lastDemand, idleSince, quantity, now); reason != "" {
+			changes = append(changes, change{product, price, next, reason})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ch := range changes {
+		if err := changePrice(ctx, db, rdb, ch.product, ch.price, ch.next, ch.reason, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updates the price only if it is still the evaluated one and records the change
+func changePrice(ctx context.Context, db *sql.DB, rdb *redis.Client, product string, price float64, next float64, reason string, now time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var world string
+	err = tx.QueryRowContext(ctx, "UPDATE Products SET price = $1 WHERE id = $2 AND price = $3 RETURNING world_id;", next, product, price).Scan(&world)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO PriceChanges(product_id, old_price, new_price, reason, created) VALUES($1, $2, $3, $4, $5);",
+		product, price, next, reason, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateProducts(ctx, rdb, world, product)
+	return nil
+}
+
+func pricingPut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	id, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	productId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var rule struct {
+		Code string `json:"code" binding:"required,len=4"`
+		pricingRule
+	}
+	if err := c.BindJSON(&rule); err != nil {
+		return
+	}
+	if rule.Floor > 0 && rule.Ceiling > 0 && rule.Floor > rule.Ceiling {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if rule.Enabled == nil {
+		enabled := true
+		rule.Enabled = &enabled
+	}
+	var code string
+	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1 AND Products.id = $2;", id.(string), productId).Scan(&code)
+
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if code != rule.Code {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	//the rule it replaces is kept in the audit log
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	var before any
+	var previous pricingRule
+	err = tx.QueryRowContext(ctx, "SELECT "+pricingColumns+" FROM PricingRules WHERE product_id = $1 FOR UPDATE;", productId).Scan(previous.fields()...)
+	if err == nil {
+		before = previous
+	} else if err != sql.ErrNoRows {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO PricingRules(product_id, demand_step, demand_threshold, demand_window_hours, clearance_step,"+
+		" clearance_after_hours, floor, ceiling, enabled, updated) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"+
+		" ON CONFLICT (product_id) DO UPDATE SET demand_step = EXCLUDED.demand_step, demand_threshold = EXCLUDED.demand_threshold,"+
+		" demand_window_hours = EXCLUDED.demand_window_hours, clearance_step = EXCLUDED.clearance_step,"+
+		" clearance_after_hours = EXCLUDED.clearance_after_hours, floor = EXCLUDED.floor, ceiling = EXCLUDED.ceiling,"+
+		" enabled = EXCLUDED.enabled, updated = EXCLUDED.updated;", productId, rule.DemandStep, rule.DemandThreshold,
+		rule.DemandWindowHours, rule.ClearanceStep, rule.ClearanceAfterHours, rule.Floor, rule.Ceiling, rule.Enabled, clock.Now())
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := audit(ctx, tx, worldOf(c), id.(string), auditPricingSet, "product", productId, before, rule.pricingRule); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func pricingDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	id, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	productId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var product struct {
+		Code string `json:"code" binding:"required,len=4"`
+	}
+	if err := c.BindJSON(&product); err != nil {
+		return
+	}
+	var code string
+	err := db.QueryRow("SELECT Cards.code FROM Products JOIN Cards ON Products.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1 AND Products.id = $2;", id.(string), productId).Scan(&code)
+
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if code != product.Code {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	var before any
+	var previous pricingRule
+	err = tx.QueryRowContext(ctx, "DELETE FROM PricingRules WHERE product_id = $1 RETURNING "+pricingColumns+";", productId).Scan(previous.fields()...)
+	if err == nil {
+		before = previous
+	} else if err != sql.ErrNoRows {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := audit(ctx, tx, worldOf(c), id.(string), auditPricingDelete, "product", productId, before, nil); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// the seller's rule for the product
+func pricingGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	id, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	productId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var rule pricingRule
+	err := db.QueryRow("SELECT "+pricingColumns+" FROM PricingRules JOIN Products ON Products.id = PricingRules.product_id JOIN Cards"+
+		" ON Products.card_id = Cards.id WHERE Cards.user_id = $1 AND Products.id = $2;", id.(string), productId).Scan(rule.fields()...)
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"rule": rule})
+}
+
+// public price history of a product, newest first
+func priceHistoryGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	productId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var changes []struct {
+		Old       string `json:"old"`
+		New       string `json:"new"`
+		Reason    string `json:"reason"`
+		Timestamp string `json:"timestamp"`
+	}
+	rows, err := db.Query("SELECT old_price, new_price, reason, PriceChanges.created FROM PriceChanges JOIN Products"+
+		" ON Products.id = PriceChanges.product_id WHERE product_id = $1 AND Products.world_id = $2"+
+		" ORDER BY PriceChanges.created DESC LIMIT "+strconv.Itoa(limit)+" OFFSET "+strconv.Itoa(offset)+";", productId, worldOf(c))
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change struct {
+			Old       string `json:"old"`
+			New       string `json:"new"`
+			Reason    string `json:"reason"`
+			Timestamp string `json:"timestamp"`
+		}
+		if err := rows.Scan(&change.Old, &change.New, &change.Reason, &change.Timestamp); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		changes = append(changes, change)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"changes": changes})
+}
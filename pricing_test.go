@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluatePricing(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	demand := pricingRule{DemandStep: 0.1, DemandThreshold: 5, DemandWindowHours: 24}
+	clearance := pricingRule{ClearanceStep: 0.2, ClearanceAfterHours: 48}
+	both := pricingRule{DemandStep: 0.1, DemandThreshold: 5, DemandWindowHours: 24, ClearanceStep: 0.2, ClearanceAfterHours: 48}
+	tests := []struct {
+		name       string
+		rule       pricingRule
+		price      float64
+		sold       int
+		lastDemand time.Duration //before now
+		idle       time.Duration //since the last sale or price change
+		quantity   int
+		want       float64
+		reason     string
+	}{
+		{"demand raises", demand, 10, 5, 48 * time.Hour, 0, 3, 11, "demand"},
+		{"below threshold", demand, 10, 4, 48 * time.Hour, 0, 3, 10, ""},
+		{"once per window", demand, 10, 9, 2 * time.Hour, 0, 3, 10, ""},
+		{"demand without window", pricingRule{DemandStep: 0.1, DemandThreshold: 5}, 10, 9, 48 * time.Hour, 0, 3, 10, ""},
+		{"clearance discounts", clearance, 10, 0, 0, 49 * time.Hour, 3, 8, "clearance"},
+		{"clearance too early", clearance, 10, 0, 0, 47 * time.Hour, 3, 10, ""},
+		{"nothing to clear", clearance, 10, 0, 0, 49 * time.Hour, 0, 10, ""},
+		{"demand before clearance", both, 10, 5, 48 * time.Hour, 49 * time.Hour, 3, 11, "demand"},
+		{"floor", pricingRule{ClearanceStep: 0.5, ClearanceAfterHours: 1, Floor: 7}, 10, 0, 0, 2 * time.Hour, 1, 7, "floor"},
+		{"ceiling", pricingRule{DemandStep: 0.5, DemandThreshold: 1, DemandWindowHours: 1, Ceiling: 12}, 10, 1, 2 * time.Hour, 0, 1, 12, "ceiling"},
+		{"raised to floor without a rule firing", pricingRule{Floor: 15}, 10, 0, 0, 0, 1, 15, "floor"},
+		{"already at floor", pricingRule{ClearanceStep: 0.5, ClearanceAfterHours: 1, Floor: 10}, 10, 0, 0, 2 * time.Hour, 1, 10, ""},
+		{"rounded to cents", demand, 9.99, 5, 48 * time.Hour, 0, 1, 10.99, "demand"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, reason := evaluatePricing(test.rule, test.price, test.sold, now.Add(-test.lastDemand), now.Add(-test.idle), test.quantity, now)
+			if got != test.want || reason != test.reason {
+				t.Fatalf("got %v %q, want %v %q", got, reason, test.want, test.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Recommender returns product ids, best match first
+type Recommender interface {
+	Related(ctx context.Context, productId string, limit int) ([]string, error)
+	ForUser(ctx context.Context, userId string, limit int) ([]string, error)
+}
+
+// uses the recommendation service at recommender.url when set, otherwise the built-in co-purchase recommender
+func newRecommender(db *sql.DB) Recommender {
+	local := &coPurchaseRecommender{db: db}
+	base := settings.Recommend.URL
+	if base == "" {
+		return local
+	}
+	return &httpRecommender{
+		base:     strings.TrimRight(base, "/"),
+		client:   &http.Client{Timeout: settings.Recommend.Timeout},
+		fallback: local,
+	}
+}
+
+// client for the external recommendation service, any failure falls back to the local recommender
+type httpRecommender struct {
+	base     string
+	client   *http.Client
+	fallback Recommender
+}
+
+func (r *httpRecommender) Related(ctx context.Context, productId string, limit int) ([]string, error) {
+	ids, err := r.get(ctx, "/products/"+url.PathEscape(productId)+"/related", limit)
+	if err != nil {
+		return r.fallback.Related(ctx, productId, limit)
+	}
+	return ids, nil
+}
+
+func (r *httpRecommender) ForUser(ctx context.Context, userId string, limit int) ([]string, error) {
+	ids, err := r.get(ctx, "/users/"+url.PathEscape(userId)+"/recommendations", limit)
+	if err != nil {
+		return r.fallback.ForUser(ctx, userId, limit)
+	}
+	return ids, nil
+}
+
+// expects a response of the form {"products": [id, ...]}
+func (r *httpRecommender) get(ctx context.Context, path string, limit int) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.base+path+"?limit="+strconv.Itoa(limit), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("recommender responded with " + res.Status)
+	}
+	var body struct {
+		Products []json.Number `json:"products"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(body.Products))
+	for _, id := range body.Products {
+		ids = append(ids, id.String())
+	}
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+// ranks products by how many buyers purchased them together with a given product
+type coPurchaseRecommender struct {
+	db *sql.DB
+}
+
+func (r *coPurchaseRecommender) Related(ctx context.Context, productId string, limit int) ([]string, error) {
+	return r.query(ctx, "SELECT o2.product_id FROM Orders AS o1 JOIN Cards AS c1 ON o1.card_id = c1.id JOIN Cards AS c2"+
+		" ON c1.user_id = c2.user_id JOIN Orders AS o2 ON o2.card_id = c2.id JOIN Products ON Products.id = o2.product_id"+
+		" WHERE o1.product_id = $1 AND o2.product_id <> o1.product_id AND Products.status = 'A'"+activeSeller+
+		" GROUP BY o2.product_id ORDER BY COUNT(DISTINCT c2.user_id) DESC, o2.product_id LIMIT $2;", productId, limit)
+}
+
+// products co-purchased with the user's history that they have not bought yet, best sellers if they have no history
+func (r *coPurchaseRecommender) ForUser(ctx context.Context, userId string, limit int) ([]string, error) {
+	ids, err := r.query(ctx, "WITH bought AS (SELECT DISTINCT Orders.product_id FROM Orders JOIN Cards ON Orders.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1) SELECT o2.product_id FROM bought JOIN Orders AS o1 ON o1.product_id = bought.product_id"+
+		" JOIN Cards AS c1 ON o1.card_id = c1.id JOIN Cards AS c2 ON c1.user_id = c2.user_id JOIN Orders AS o2 ON o2.card_id = c2.id"+
+		" JOIN Products ON Products.id = o2.product_id WHERE c1.user_id <> $1 AND Products.status = 'A'"+activeSeller+
+		" AND o2.product_id NOT IN (SELECT product_id FROM bought) GROUP BY o2.product_id"+
+		" ORDER BY COUNT(DISTINCT c2.user_id) DESC, o2.product_id LIMIT $2;", userId, limit)
+	if err != nil || len(ids) > 0 {
+		return ids, err
+	}
+	return r.query(ctx, "SELECT Orders.product_id FROM Orders JOIN Products ON Products.id = Orders.product_id"+
+		" WHERE Products.status = 'A' AND Products.world_id = (SELECT world_id FROM Users WHERE id = $2)"+activeSeller+
+		" GROUP BY Orders.product_id ORDER BY SUM(Orders.quantity) DESC, Orders.product_id LIMIT $1;", limit, userId)
+}
+
+func (r *coPurchaseRecommender) query(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func relatedGet(c *gin.Context, db *sql.DB, rdb *redis.Client, recommender Recommender) {
+	id, hasId := c.Params.Get("id")
+	if !hasId {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, _, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	ids, err := recommender.Related(c.Request.Context(), id, limit)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	productListResponse(c, db, ids)
+}
+
+func recommendationsGet(c *gin.Context, db *sql.DB, rdb *redis.Client, recommender Recommender) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	limit, _, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	ids, err := recommender.ForUser(c.Request.Context(), uid.(string), limit)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	productListResponse(c, db, ids)
+}
+
+// condition on Products leaving out the listings of banned sellers
+const activeSeller = " AND Products.card_id NOT IN (SELECT Cards.id FROM Cards JOIN Users ON Users.id = Cards.user_id WHERE Users.status = 'B')"
+
+// responds with the active products of the request's world among ids, keeping the order of ids.
+// trending and best selling ids come from sorted sets, listings taken down or of banned sellers are left out here
+func productListResponse(c *gin.Context, db *sql.DB, ids []string) {
+	type product struct {
+		Id          string `json:"id"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Department  string `json:"department"`
+		Quantity    string `json:"quantity"`
+		Price       string `json:"price"`
+	}
+	found := map[string]product{}
+	rows, err := db.Query("SELECT id, name, description, department, quantity, price FROM Products"+
+		" WHERE id::text = ANY($1) AND status = 'A' AND world_id = $2"+activeSeller+";", pq.Array(ids), worldOf(c))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p product
+		if err := rows.Scan(&p.Id, &p.Name, &p.Description, &p.Department, &p.Quantity, &p.Price); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		found[p.Id] = p
+	}
+	products := []product{}
+	for _, id := range ids {
+		if p, ok := found[id]; ok {
+			products = append(products, p)
+		}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"products": products})
+}
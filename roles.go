@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+
+	"example/ecommsimapis/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// permissions checked by requirePermission, the roles holding them are seeded in schema.go
+const (
+	permBan       = "users.ban"
+	permRoles     = "roles.manage"
+	permEvents    = "events.read"
+	permClock     = "clock.manage"
+	permWorlds    = "worlds.manage"
+	permSnapshots = "snapshots.manage"
+	permAudit     = "audit.read"
+	permModerate  = "products.moderate"
+	permStatus    = "status.read"
+	permSell      = "products.sell"
+	permBuy       = "orders.create"
+	permReview    = "reviews.write"
+)
+
+// every new account can shop and sell
+const defaultRolesQuery = "INSERT INTO UserRoles(user_id, role, created) SELECT $1, name, $2 FROM Roles" +
+	" WHERE name IN ('buyer', 'seller') ON CONFLICT DO NOTHING;"
+
+// permissions of the user, cached until their roles change
+func userPermissions(ctx context.Context, db *sql.DB, rdb *redis.Client, id string) (map[string]bool, error) {
+	names, err := cache.Fetch(ctx, rdb, permissionCache, id, func() ([]string, error) {
+		rows, err := db.QueryContext(ctx, "SELECT DISTINCT permission FROM UserRoles JOIN RolePermissions"+
+			" ON RolePermissions.role = UserRoles.role WHERE UserRoles.user_id = $1 ORDER BY permission;", id)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		names := []string{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+		return names, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	permissions := map[string]bool{}
+	for _, name := range names {
+		permissions[name] = true
+	}
+	return permissions, nil
+}
+
+// aborts unless the authenticated user has a role granting permission
+func requirePermission(c *gin.Context, db *sql.DB, rdb *redis.Client, permission string) {
+	id, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		c.Abort()
+		return
+	}
+	permissions, err := userPermissions(c.Request.Context(), db, rdb, id.(string))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		c.Abort()
+		return
+	}
+	if !permissions[permission] {
+		c.Status(http.StatusUnauthorized)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// grants or revokes a role and records who did it, false if nothing changed
+func changeRole(ctx context.Context, db *sql.DB, rdb *redis.Client, user string, role string, grant bool, actor sql.NullString) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	//locks the user so concurrent changes record the roles they saw
+	var world string
+	if err := tx.QueryRowContext(ctx, "SELECT world_id FROM Users WHERE id = $1 FOR UPDATE;", user).Scan(&world); err != nil {
+		return false, err
+	}
+	before, err := heldRoles(ctx, tx, user)
+	if err != nil {
+		return false, err
+	}
+	var result sql.Result
+	if grant {
+		result, err = tx.ExecContext(ctx, "INSERT INTO UserRoles(user_id, role, created) VALUES($1, $2, $3) ON CONFLICT DO NOTHING;",
+			user, role, clock.Now())
+	} else {
+		result, err = tx.ExecContext(ctx, "DELETE FROM UserRoles WHERE user_id = $1 AND role = $2;", user, role)
+	}
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO RoleChanges(user_id, role, granted, actor_id, created) VALUES($1, $2, $3, $4, $5);",
+		user, role, grant, actor, clock.Now()); err != nil {
+		return false, err
+	}
+	after, err := heldRoles(ctx, tx, user)
+	if err != nil {
+		return false, err
+	}
+	action := auditRoleRevoke
+	if grant {
+		action = auditRoleGrant
+	}
+	if err := audit(ctx, tx, world, actor.String, action, "user", user, map[string]any{"roles": before}, map[string]any{"roles": after}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	permissionCache.Delete(ctx, rdb, user)
+	return true, nil
+}
+
+func heldRoles(ctx context.Context, tx *sql.Tx, user string) ([]string, error) {
+	roles := []string{}
+	rows, err := tx.QueryContext(ctx, "SELECT role FROM UserRoles WHERE user_id = $1 ORDER BY role;", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// role grant|revoke <user id> <role>, for giving the first admin of a world its role
+func roleCommand(args []string) error {
+	flags := flag.NewFlagSet("role", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 3 || (flags.Arg(0) != "grant" && flags.Arg(0) != "revoke") {
+		return errors.New("usage: role grant|revoke <user id> <role>")
+	}
+	db, rdb := connect()
+	_, err := changeRole(context.Background(), db, rdb, flags.Arg(1), flags.Arg(2), flags.Arg(0) == "grant", sql.NullString{})
+	return err
+}
+
+// roles and the permissions they grant
+func rolesGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	rows, err := db.Query("SELECT Roles.name, COALESCE(string_agg(RolePermissions.permission, ',' ORDER BY RolePermissions.permission), '')" +
+		" FROM Roles LEFT JOIN RolePermissions ON RolePermissions.role = Roles.name GROUP BY Roles.name ORDER BY Roles.name;")
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	roles := map[string][]string{}
+	for rows.Next() {
+		var name, permissions string
+		if err := rows.Scan(&name, &permissions); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		roles[name] = []string{}
+		if permissions != "" {
+			roles[name] = strings.Split(permissions, ",")
+		}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// the user's roles and every change made to them, newest first
+func userRolesGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	id, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var found bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE id::text = $1 AND world_id = $2);", id, worldOf(c)).Scan(&found); err != nil || !found {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	roles := []string{}
+	rows, err := db.Query("SELECT role FROM UserRoles WHERE user_id = $1 ORDER BY role;", id)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	var history []struct {
+		Role      string `json:"role"`
+		Granted   bool   `json:"granted"`
+		Actor     string `json:"actor,omitempty"`
+		Timestamp string `json:"timestamp"`
+	}
+	changes, err := db.Query("SELECT role, granted, COALESCE(actor_id::text, ''), created FROM RoleChanges WHERE user_id = $1"+
+		" ORDER BY created DESC, id DESC;", id)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer changes.Close()
+	for changes.Next() {
+		var change struct {
+			Role      string `json:"role"`
+			Granted   bool   `json:"granted"`
+			Actor     string `json:"actor,omitempty"`
+			Timestamp string `json:"timestamp"`
+		}
+		if err := changes.Scan(&change.Role, &change.Granted, &change.Actor, &change.Timestamp); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		history = append(history, change)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"roles": roles, "history": history})
+}
+
+func userRolePut(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	userRoleChange(c, db, rdb, true)
+}
+
+func userRoleDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	userRoleChange(c, db, rdb, false)
+}
+
+func userRoleChange(c *gin.Context, db *sql.DB, rdb *redis.Client, grant bool) {
+	actor, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	id, hasId := c.Params.Get("id")
+	role, hasRole := c.Params.Get("role")
+	if !hasId || !hasRole {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	//admins cannot lock themselves out
+	if !grant && role == "admin" && id == actor.(string) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var found bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE id::text = $1 AND world_id = $2) AND EXISTS(SELECT 1 FROM Roles WHERE name = $3);",
+		id, worldOf(c), role).Scan(&found); err != nil || !found {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	if _, err := changeRole(c.Request.Context(), db, rdb, id, role, grant, sql.NullString{String: actor.(string), Valid: true}); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// scripted market setup, written in YAML or JSON
+//
+//	name: holiday-rush
+//	seed: 7
+//	users:
+//	  - name: alice
+//	    email: alice@example.com
+//	    cards:
+//	      - {number: "111122223333", code: "1234", balance: 1000}
+//	products:
+//	  - {key: lamp, seller: alice, card: "111122223333", name: Desk Lamp, description: A lamp, department: home, quantity: 10, price: 25}
+//	events:
+//	  - {at: 30s, type: price, product: lamp, price: 35}
+//	  - {at: 1m, type: stock, product: lamp, quantity: 2}
+//	  - {at: 2m, type: shoppers, buyers: 10, rounds: 5, budget: 200}
+type scenario struct {
+	Name     string            `yaml:"name"`
+	Seed     int64             `yaml:"seed"`
+	Users    []scenarioUser    `yaml:"users"`
+	Products []scenarioProduct `yaml:"products"`
+	Events   []scenarioEvent   `yaml:"events"`
+	World    string            `yaml:"-"`
+}
+
+type scenarioUser struct {
+	Name  string `yaml:"name"`
+	Email string `yaml:"email"`
+	Cards []struct {
+		Number  string  `yaml:"number"`
+		Code    string  `yaml:"code"`
+		Balance float64 `yaml:"balance"`
+	} `yaml:"cards"`
+}
+
+type scenarioProduct struct {
+	Key         string  `yaml:"key"`
+	Seller      string  `yaml:"seller"`
+	Card        string  `yaml:"card"`
+	Name        string  `yaml:"name"`
+	Description string  `yaml:"description"`
+	Department  string  `yaml:"department"`
+	Quantity    int     `yaml:"quantity"`
+	Price       float64 `yaml:"price"`
+}
+
+// at is an offset in simulated time from the start of the run
+type scenarioEvent struct {
+	At          string   `yaml:"at"`
+	Type        string   `yaml:"type"`
+	Product     string   `yaml:"product"`
+	Price       float64  `yaml:"price"`
+	Quantity    int      `yaml:"quantity"`
+	Buyers      int      `yaml:"buyers"`
+	Rounds      int      `yaml:"rounds"`
+	Budget      float64  `yaml:"budget"`
+	Departments []string `yaml:"departments"`
+	offset      time.Duration
+}
+
+type scenarioReport struct {
+	Name     string  `json:"name"`
+	Duration string  `json:"duration"`
+	Orders   int     `json:"orders"`
+	Units    int     `json:"units"`
+	Revenue  float64 `json:"revenue"`
+	Products []struct {
+		Key      string `json:"key"`
+		Price    string `json:"price"`
+		Quantity string `json:"quantity"`
+		Sold     string `json:"sold"`
+	} `json:"products"`
+	Balances map[string]string `json:"balances"`
+	Shoppers []simStats        `json:"shoppers"`
+}
+
+func scenarioCommand(args []string) error {
+	flags := flag.NewFlagSet("scenario", flag.ExitOnError)
+	seed := flags.Int64("seed", 0, "overrides the scenario's seed")
+	world := flags.String("world", "", "id or name of the world to play the scenario in")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: scenario [-seed n] [-world name] file.yaml")
+	}
+	sc, err := loadScenario(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *seed != 0 {
+		sc.Seed = *seed
+	}
+
+	db, rdb := connect()
+	if sc.World, err = findWorld(db, *world); err != nil {
+		return fmt.Errorf("world %q: %w", *world, err)
+	}
+	events := newEventRecorder(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	go events.run(ctx)
+	report, err := runScenario(sc, db, rdb, events)
+	cancel()
+	<-events.done
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(report, "", "    ")
+	fmt.Println(string(out))
+	return nil
+}
+
+// JSON files parse as YAML too
+func loadScenario(path string) (*scenario, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc scenario
+	if err := yaml.Unmarshal(buf, &sc); err != nil {
+		return nil, err
+	}
+	return &sc, sc.validate()
+}
+
+func (sc *scenario) validate() error {
+	users := map[string]bool{}
+	cards := map[string]bool{}
+	for _, user := range sc.Users {
+		if user.Name == "" || user.Email == "" {
+			return errors.New("every user needs a name and an email")
+		}
+		users[user.Name] = true
+		for _, card := range user.Cards {
+			if len(card.Number) != 12 || len(card.Code) != 4 {
+				return errors.New("card numbers have 12 digits and codes 4, check user " + user.Name)
+			}
+			cards[user.Name+":"+card.Number] = true
+		}
+	}
+	products := map[string]bool{}
+	for _, product := range sc.Products {
+		if product.Key == "" || !users[product.Seller] {
+			return errors.New("product " + product.Name + " needs a key and a seller listed under users")
+		}
+		if !cards[product.Seller+":"+product.Card] {
+			return fmt.Errorf("product %s: card %s does not belong to %s", product.Key, product.Card, product.Seller)
+		}
+		if product.Quantity < 1 || product.Quantity > math.MaxInt16 || product.Price <= 0 {
+			return errors.New("product " + product.Key + " needs a quantity and a price")
+		}
+		products[product.Key] = true
+	}
+	for i := range sc.Events {
+		e := &sc.Events[i]
+		offset, err := time.ParseDuration(e.At)
+		if err != nil || offset < 0 {
+			return fmt.Errorf("event %d: invalid offset %q", i+1, e.At)
+		}
+		e.offset = offset
+		switch e.Type {
+		case "price", "stock":
+			if !products[e.Product] {
+				return fmt.Errorf("event %d: unknown product %q", i+1, e.Product)
+			}
+			if (e.Type == "price" && e.Price <= 0) || (e.Type == "stock" && (e.Quantity < 0 || e.Quantity > math.MaxInt16)) {
+				return fmt.Errorf("event %d: invalid %s", i+1, e.Type)
+			}
+		case "shoppers":
+			if e.Buyers < 1 || e.Rounds < 1 {
+				return fmt.Errorf("event %d: shoppers need buyers and rounds", i+1)
+			}
+		default:
+			return fmt.Errorf("event %d: unknown type %q", i+1, e.Type)
+		}
+	}
+	sort.SliceStable(sc.Events, func(i, j int) bool { return sc.Events[i].offset < sc.Events[j].offset })
+	return nil
+}
+
+func runScenario(sc *scenario, db *sql.DB, rdb *redis.Client, events *eventRecorder) (*scenarioReport, error) {
+	start := clock.Now()
+	report := &scenarioReport{Name: sc.Name, Balances: map[string]string{}}
+	if sc.World == "" {
+		sc.World = defaultWorld
+	}
+
+	users, products, err := seedScenario(sc, db)
+	if err != nil {
+		return nil, err
+	}
+	searchCache.Invalidate(context.Background(), rdb, sc.World)
+
+	for i, e := range sc.Events {
+		scenarioWait(start.Add(e.offset))
+		var err error
+		switch e.Type {
+		case "price":
+			var price float64
+			if err = db.QueryRow("SELECT price FROM Products WHERE id = $1;", products[e.Product]).Scan(&price); err == nil {
+				err = changePrice(context.Background(), db, rdb, products[e.Product], price, e.Price, "scenario", clock.Now())
+			}
+		case "stock":
+			if _, err = db.Exec("UPDATE Products SET quantity = $1 WHERE id = $2;", e.Quantity, products[e.Product]); err == nil {
+				invalidateProducts(context.Background(), rdb, sc.World, products[e.Product])
+			}
+		case "shoppers":
+			cfg := simConfig{Buyers: e.Buyers, Budget: e.Budget, Rounds: e.Rounds, Departments: e.Departments, Seed: sc.Seed + int64(i), World: sc.World}
+			if cfg.Budget == 0 {
+				cfg.Budget = defaultSimConfig().Budget
+			}
+			if len(cfg.Departments) == 0 {
+				for _, product := range sc.Products {
+					cfg.Departments = append(cfg.Departments, product.Department)
+				}
+			}
+			var stats simStats
+			stats, err = runSimulation(context.Background(), cfg, db, rdb, events)
+			report.Shoppers = append(report.Shoppers, stats)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", i+1, err)
+		}
+	}
+
+	return report, scenarioOutcome(report, sc, db, start, users, products)
+}
+
+// inserts the users, cards and listings in one transaction so a failed run leaves the world as it was.
+// listings are active right away, the moderation queue does not hold up a scripted market
+func seedScenario(sc *scenario, db *sql.DB) (map[string]*simAgent, map[string]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	users := map[string]*simAgent{}
+	for _, user := range sc.Users {
+		agent := &simAgent{}
+		if err := tx.QueryRow("INSERT INTO Users(name, email, status, created, world_id) VALUES($1, $2, 'A', $3, $4) RETURNING id;",
+			user.Name, user.Email, clock.Now(), sc.World).Scan(&agent.id); err != nil {
+			return nil, nil, fmt.Errorf("user %s: %w", user.Name, err)
+		}
+		if _, err := tx.Exec(defaultRolesQuery, agent.id, clock.Now()); err != nil {
+			return nil, nil, fmt.Errorf("user %s: %w", user.Name, err)
+		}
+		for _, card := range user.Cards {
+			if _, err := tx.Exec("INSERT INTO Cards(user_id, number, code, balance, created, world_id) VALUES($1, $2, $3, $4, $5, $6);",
+				agent.id, card.Number, card.Code, card.Balance, clock.Now(), sc.World); err != nil {
+				return nil, nil, fmt.Errorf("card %s: %w", card.Number, err)
+			}
+		}
+		users[user.Name] = agent
+	}
+
+	products := map[string]string{}
+	for _, product := range sc.Products {
+		var id string
+		if err := tx.QueryRow("INSERT INTO Products(card_id, name, description, department, quantity, price, status, created, world_id)"+
+			" SELECT id, $3, $4, $5, $6, $7, 'A', $8, $9 FROM Cards WHERE user_id = $1 AND number = $2 RETURNING id;",
+			users[product.Seller].id, product.Card, product.Name, product.Description, product.Department, product.Quantity,
+			strconv.FormatFloat(product.Price, 'f', 2, 64), clock.Now(), sc.World).Scan(&id); err != nil {
+			return nil, nil, fmt.Errorf("product %s: %w", product.Key, err)
+		}
+		products[product.Key] = id
+	}
+	return users, products, tx.Commit()
+}
+
+// frozen clocks are stepped forward to the event, otherwise the run waits for it
+func scenarioWait(t time.Time) {
+	for {
+		remaining := t.Sub(clock.Now())
+		if remaining <= 0 {
+			return
+		}
+		if clock.Mode() == clockFrozen {
+			clock.Advance(remaining)
+			return
+		}
+		time.Sleep(min(remaining, 100*time.Millisecond))
+	}
+}
+
+func scenarioOutcome(report *scenarioReport, sc *scenario, db *sql.DB, start time.Time, users map[string]*simAgent, products map[string]string) error {
+	report.Duration = clock.Now().Sub(start).String()
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(Orders.quantity), 0), COALESCE(SUM(Orders.quantity * Orders.price), 0)"+
+		" FROM Orders WHERE Orders.created >= $1 AND Orders.world_id = $2;", start, sc.World).
+		Scan(&report.Orders, &report.Units, &report.Revenue); err != nil {
+		return err
+	}
+	for _, product := range sc.Products {
+		var p struct {
+			Key      string `json:"key"`
+			Price    string `json:"price"`
+			Quantity string `json:"quantity"`
+			Sold     string `json:"sold"`
+		}
+		p.Key = product.Key
+		if err := db.QueryRow("SELECT price, quantity, (SELECT COALESCE(SUM(quantity), 0) FROM Orders WHERE product_id = $1)"+
+			" FROM Products WHERE id = $1;", products[product.Key]).Scan(&p.Price, &p.Quantity, &p.Sold); err != nil {
+			return err
+		}
+		report.Products = append(report.Products, p)
+	}
+	for name, user := range users {
+		var balance string
+		if err := db.QueryRow("SELECT COALESCE(SUM(balance), 0) FROM Cards WHERE user_id = $1;", user.id).Scan(&balance); err != nil {
+			return err
+		}
+		report.Balances[name] = balance
+	}
+	return nil
+}
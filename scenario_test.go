@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testScenario = `
+name: test
+users:
+  - name: ann
+    email: ann@example.com
+    cards:
+      - {number: "111122223333", code: "1234", balance: 100}
+products:
+  - {key: lamp, seller: ann, card: "111122223333", name: Lamp, department: home, quantity: 5, price: 20}
+events:
+  - {at: 2h, type: shoppers, buyers: 3, rounds: 2}
+  - {at: 30m, type: price, product: lamp, price: 25}
+  - {at: 1h, type: stock, product: lamp, quantity: 10}
+`
+
+func parseScenario(t *testing.T) *scenario {
+	t.Helper()
+	var sc scenario
+	if err := yaml.Unmarshal([]byte(testScenario), &sc); err != nil {
+		t.Fatal(err)
+	}
+	return &sc
+}
+
+func TestScenarioValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(sc *scenario)
+		want   string
+	}{
+		{"valid", func(sc *scenario) {}, ""},
+		{"user without email", func(sc *scenario) { sc.Users[0].Email = "" }, "name and an email"},
+		{"short card number", func(sc *scenario) { sc.Users[0].Cards[0].Number = "1111" }, "check user ann"},
+		{"long code", func(sc *scenario) { sc.Users[0].Cards[0].Code = "12345" }, "check user ann"},
+		{"product without key", func(sc *scenario) { sc.Products[0].Key = "" }, "needs a key"},
+		{"unknown seller", func(sc *scenario) { sc.Products[0].Seller = "bob" }, "seller listed under users"},
+		{"card of someone else", func(sc *scenario) { sc.Products[0].Card = "999999999999" }, "does not belong to ann"},
+		{"no quantity", func(sc *scenario) { sc.Products[0].Quantity = 0 }, "lamp needs a quantity and a price"},
+		{"free product", func(sc *scenario) { sc.Products[0].Price = 0 }, "lamp needs a quantity and a price"},
+		{"bad offset", func(sc *scenario) { sc.Events[0].At = "soon" }, `event 1: invalid offset "soon"`},
+		{"negative offset", func(sc *scenario) { sc.Events[0].At = "-1h" }, "event 1: invalid offset"},
+		{"unknown product", func(sc *scenario) { sc.Events[1].Product = "desk" }, `event 2: unknown product "desk"`},
+		{"shoppers without rounds", func(sc *scenario) { sc.Events[0].Rounds = 0 }, "event 1: shoppers need buyers and rounds"},
+		{"free price event", func(sc *scenario) { sc.Events[1].Price = 0 }, "event 2: invalid price"},
+		{"negative stock", func(sc *scenario) { sc.Events[2].Quantity = -1 }, "event 3: invalid stock"},
+		{"unknown type", func(sc *scenario) { sc.Events[2].Type = "flood" }, `event 3: unknown type "flood"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc := parseScenario(t)
+			test.change(sc)
+			err := sc.validate()
+			if test.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestScenarioValidateOrdersEvents(t *testing.T) {
+	sc := parseScenario(t)
+	if err := sc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{30 * time.Minute, time.Hour, 2 * time.Hour}
+	for i, e := range sc.Events {
+		if e.offset != want[i] {
+			t.Fatalf("event %d at %s, want %s", i, e.offset, want[i])
+		}
+	}
+}
+
+func TestExampleScenario(t *testing.T) {
+	if _, err := loadScenario("scenarios/example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
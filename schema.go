@@ -0,0 +1,216 @@
+package main
+
+import "database/sql"
+
+// tables created on startup if they do not exist yet
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS Worlds(
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		created TIMESTAMP NOT NULL
+	);`,
+	`INSERT INTO Worlds(id, name, created) VALUES(1, 'default', NOW()) ON CONFLICT DO NOTHING;`,
+	`SELECT setval(pg_get_serial_sequence('worlds', 'id'), MAX(id)) FROM Worlds;`,
+	`CREATE TABLE IF NOT EXISTS ReviewVotes(
+		review_id INTEGER NOT NULL REFERENCES Reviews(id),
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		helpful BOOLEAN NOT NULL,
+		created TIMESTAMP NOT NULL,
+		PRIMARY KEY(review_id, user_id)
+	);`,
+	`CREATE TABLE IF NOT EXISTS ReviewReplies(
+		review_id INTEGER PRIMARY KEY REFERENCES Reviews(id),
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		reply TEXT NOT NULL,
+		created TIMESTAMP NOT NULL,
+		edited TIMESTAMP
+	);`,
+	`CREATE TABLE IF NOT EXISTS Wishlists(
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		name TEXT NOT NULL,
+		public BOOLEAN NOT NULL DEFAULT FALSE,
+		share_token TEXT UNIQUE,
+		created TIMESTAMP NOT NULL,
+		UNIQUE(user_id, name)
+	);`,
+	`CREATE TABLE IF NOT EXISTS WishlistItems(
+		wishlist_id INTEGER NOT NULL REFERENCES Wishlists(id) ON DELETE CASCADE,
+		product_id INTEGER NOT NULL REFERENCES Products(id),
+		created TIMESTAMP NOT NULL,
+		PRIMARY KEY(wishlist_id, product_id)
+	);`,
+	`CREATE TABLE IF NOT EXISTS Events(
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		user_id INTEGER,
+		product_id INTEGER,
+		query TEXT,
+		results INTEGER,
+		quantity INTEGER,
+		created TIMESTAMP NOT NULL
+	);`,
+	`CREATE INDEX IF NOT EXISTS events_kind_created ON Events(kind, created);`,
+	`CREATE TABLE IF NOT EXISTS EconomySnapshots(
+		id SERIAL PRIMARY KEY,
+		taken TIMESTAMP NOT NULL,
+		money_supply NUMERIC NOT NULL,
+		transactions INTEGER NOT NULL,
+		volume NUMERIC NOT NULL,
+		inventory_value NUMERIC NOT NULL,
+		listings INTEGER NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS DepartmentSnapshots(
+		snapshot_id INTEGER NOT NULL REFERENCES EconomySnapshots(id) ON DELETE CASCADE,
+		department TEXT NOT NULL,
+		average_price NUMERIC NOT NULL,
+		listings INTEGER NOT NULL,
+		units INTEGER NOT NULL,
+		PRIMARY KEY(snapshot_id, department)
+	);`,
+	`CREATE TABLE IF NOT EXISTS PricingRules(
+		product_id INTEGER PRIMARY KEY REFERENCES Products(id),
+		demand_step NUMERIC NOT NULL DEFAULT 0,
+		demand_threshold INTEGER NOT NULL DEFAULT 0,
+		demand_window_hours INTEGER NOT NULL DEFAULT 0,
+		clearance_step NUMERIC NOT NULL DEFAULT 0,
+		clearance_after_hours INTEGER NOT NULL DEFAULT 0,
+		floor NUMERIC NOT NULL DEFAULT 0,
+		ceiling NUMERIC NOT NULL DEFAULT 0,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		updated TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS PriceChanges(
+		id SERIAL PRIMARY KEY,
+		product_id INTEGER NOT NULL REFERENCES Products(id),
+		old_price NUMERIC NOT NULL,
+		new_price NUMERIC NOT NULL,
+		reason TEXT NOT NULL,
+		created TIMESTAMP NOT NULL
+	);`,
+	`CREATE INDEX IF NOT EXISTS price_changes_product ON PriceChanges(product_id, created);`,
+	// rows that existed before worlds belong to the default world
+	`ALTER TABLE Users ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	`ALTER TABLE Firebase ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	`ALTER TABLE Cards ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	`ALTER TABLE Products ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	`ALTER TABLE Orders ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	`ALTER TABLE Events ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	`ALTER TABLE EconomySnapshots ADD COLUMN IF NOT EXISTS world_id INTEGER NOT NULL DEFAULT 1 REFERENCES Worlds(id);`,
+	// the same account, email or card number may exist once per world
+	`ALTER TABLE Firebase DROP CONSTRAINT IF EXISTS firebase_pkey;`,
+	`ALTER TABLE Firebase DROP CONSTRAINT IF EXISTS firebase_uid_key;`,
+	`ALTER TABLE Users DROP CONSTRAINT IF EXISTS users_email_key;`,
+	`ALTER TABLE Cards DROP CONSTRAINT IF EXISTS cards_number_key;`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS firebase_world_uid ON Firebase(world_id, uid);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_world_email ON Users(world_id, email);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS cards_world_number ON Cards(world_id, number);`,
+	`CREATE INDEX IF NOT EXISTS products_world ON Products(world_id, status);`,
+	`CREATE TABLE IF NOT EXISTS Roles(
+		name TEXT PRIMARY KEY
+	);`,
+	`CREATE TABLE IF NOT EXISTS RolePermissions(
+		role TEXT NOT NULL REFERENCES Roles(name),
+		permission TEXT NOT NULL,
+		PRIMARY KEY(role, permission)
+	);`,
+	`INSERT INTO Roles(name) VALUES('admin'), ('moderator'), ('seller'), ('buyer'), ('support') ON CONFLICT DO NOTHING;`,
+	`INSERT INTO RolePermissions(role, permission) VALUES
+		('admin', 'roles.manage'), ('admin', 'users.ban'), ('admin', 'events.read'), ('admin', 'clock.manage'),
+		('admin', 'worlds.manage'), ('admin', 'snapshots.manage'), ('admin', 'audit.read'), ('admin', 'products.moderate'), ('admin', 'status.read'),
+		('moderator', 'users.ban'), ('moderator', 'events.read'), ('moderator', 'products.moderate'), ('moderator', 'status.read'),
+		('support', 'events.read'),
+		('seller', 'products.sell'),
+		('buyer', 'orders.create'), ('buyer', 'reviews.write')
+		ON CONFLICT DO NOTHING;`,
+	`CREATE TABLE IF NOT EXISTS UserRoles(
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		role TEXT NOT NULL REFERENCES Roles(name),
+		created TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, role)
+	);`,
+	`CREATE TABLE IF NOT EXISTS RoleChanges(
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		role TEXT NOT NULL REFERENCES Roles(name),
+		granted BOOLEAN NOT NULL,
+		actor_id INTEGER REFERENCES Users(id),
+		created TIMESTAMP NOT NULL
+	);`,
+	`CREATE INDEX IF NOT EXISTS role_changes_user ON RoleChanges(user_id, created);`,
+	// users from before roles can shop and sell, and the 'M' status becomes the admin and moderator roles
+	`INSERT INTO UserRoles(user_id, role, created) SELECT Users.id, Roles.name, NOW() FROM Users, Roles
+		WHERE Roles.name IN ('buyer', 'seller') AND NOT EXISTS(SELECT 1 FROM UserRoles WHERE user_id = Users.id)
+		AND NOT EXISTS(SELECT 1 FROM RoleChanges WHERE user_id = Users.id);`,
+	`INSERT INTO UserRoles(user_id, role, created) SELECT Users.id, Roles.name, NOW() FROM Users, Roles
+		WHERE Users.status = 'M' AND Roles.name IN ('admin', 'moderator') ON CONFLICT DO NOTHING;`,
+	`UPDATE Users SET status = 'A' WHERE status = 'M';`,
+	`CREATE TABLE IF NOT EXISTS Bans(
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		moderator_id INTEGER REFERENCES Users(id),
+		reason TEXT NOT NULL,
+		created TIMESTAMP NOT NULL,
+		expires TIMESTAMP,
+		lifted TIMESTAMP,
+		lifted_by INTEGER REFERENCES Users(id)
+	);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS bans_active ON Bans(user_id) WHERE lifted IS NULL;`,
+	`CREATE INDEX IF NOT EXISTS bans_expires ON Bans(expires) WHERE lifted IS NULL;`,
+	// users banned before bans were recorded
+	`INSERT INTO Bans(user_id, reason, created) SELECT id, 'banned before ban records', NOW() FROM Users
+		WHERE status = 'B' AND NOT EXISTS(SELECT 1 FROM Bans WHERE user_id = Users.id AND lifted IS NULL);`,
+	`CREATE TABLE IF NOT EXISTS BanAppeals(
+		id SERIAL PRIMARY KEY,
+		ban_id INTEGER NOT NULL REFERENCES Bans(id),
+		user_id INTEGER NOT NULL REFERENCES Users(id),
+		text TEXT NOT NULL,
+		status TEXT NOT NULL,
+		response TEXT,
+		created TIMESTAMP NOT NULL,
+		resolved TIMESTAMP,
+		resolver_id INTEGER REFERENCES Users(id)
+	);`,
+	// ids are not foreign keys so entries outlive what they point at, resets included
+	`CREATE TABLE IF NOT EXISTS AuditLog(
+		id SERIAL PRIMARY KEY,
+		world_id INTEGER NOT NULL,
+		actor_id INTEGER,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		before JSONB,
+		after JSONB,
+		request_id TEXT,
+		created TIMESTAMP NOT NULL
+	);`,
+	// moderation of listings, the reason is set when a listing is rejected or taken down
+	`ALTER TABLE Products ADD COLUMN IF NOT EXISTS moderation_reason TEXT;`,
+	`ALTER TABLE Products ADD COLUMN IF NOT EXISTS moderator_id INTEGER REFERENCES Users(id);`,
+	`ALTER TABLE Products ADD COLUMN IF NOT EXISTS moderated TIMESTAMP;`,
+	`CREATE INDEX IF NOT EXISTS products_moderation ON Products(world_id, status, created) WHERE status IN ('P', 'T');`,
+	`CREATE INDEX IF NOT EXISTS audit_log_created ON AuditLog(created);`,
+	`CREATE INDEX IF NOT EXISTS audit_log_target ON AuditLog(target_type, target_id);`,
+	`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'AuditLog is append-only';
+	END;
+	$$ LANGUAGE plpgsql;`,
+	`DROP TRIGGER IF EXISTS audit_log_append_only ON AuditLog;`,
+	`CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON AuditLog FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();`,
+	// unit price paid, so repricing a listing does not rewrite its past sales, older orders take the price of their listing
+	`ALTER TABLE Orders ADD COLUMN IF NOT EXISTS price NUMERIC;`,
+	// resets and restores recycle ids, entries count the ones logged in their world before them
+	`ALTER TABLE AuditLog ADD COLUMN IF NOT EXISTS epoch INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE INDEX IF NOT EXISTS audit_log_epochs ON AuditLog(world_id) WHERE action IN ('world.reset', 'snapshot.restore');`,
+	`UPDATE Orders SET price = Products.price FROM Products WHERE Products.id = Orders.product_id AND Orders.price IS NULL;`,
+}
+
+func migrate(db *sql.DB) error {
+	for _, statement := range schema {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var firstNames = []string{"Ana", "Ben", "Chloe", "David", "Elena", "Farid", "Grace", "Hiro", "Ines", "Jonas", "Kara", "Liam",
+	"Maya", "Noah", "Olga", "Pedro", "Quinn", "Rosa", "Sam", "Tara", "Umar", "Vera", "Wes", "Yara", "Zoe"}
+
+var lastNames = []string{"Adams", "Baker", "Costa", "Diaz", "Evans", "Fischer", "Garcia", "Hughes", "Ito", "Jensen", "Khan",
+	"Lopez", "Moreau", "Nakamura", "Okafor", "Petrov", "Rossi", "Silva", "Tanaka", "Weber"}
+
+var streets = []string{"Maple St", "Oak Ave", "Harbor Rd", "Elm St", "Cedar Ln", "Park Blvd", "Hill Rd", "River St"}
+
+// {name} is replaced with the product name
+var descriptions = []string{
+	"A {name} built to last, backed by a one year warranty.",
+	"Our best selling {name}, loved by thousands of customers.",
+	"This {name} combines quality materials with a fair price.",
+	"A thoughtfully designed {name} for everyday use.",
+	"The {name} you have been looking for, now back in stock.",
+}
+
+// review texts by rating
+var reviewTexts = map[int][]string{
+	1: {"Broke after a week.", "Not as described, would not buy again."},
+	2: {"Disappointing quality for the price.", "It works, but barely."},
+	3: {"Does the job, nothing special.", "Average, shipping was slow."},
+	4: {"Good value, would recommend.", "Very happy with it, minor flaws."},
+	5: {"Excellent, exactly what I needed!", "Perfect, buying another one."},
+}
+
+type seedConfig struct {
+	Users    int
+	Sellers  int //users among Users that list products
+	Products int
+	Orders   int
+	Reviews  int
+	Balance  float64 //average starting balance of a card
+	Days     int     //how far back the generated history reaches
+	Seed     int64
+	World    string
+}
+
+type seedStats struct {
+	World    string  `json:"world"`
+	Users    int     `json:"users"`
+	Cards    int     `json:"cards"`
+	Products int     `json:"products"`
+	Orders   int     `json:"orders"`
+	Reviews  int     `json:"reviews"`
+	Volume   float64 `json:"volume"`
+}
+
+type seedUser struct {
+	id      string
+	cards   []seedCard
+	created time.Time
+}
+
+type seedCard struct {
+	id      string
+	balance float64
+}
+
+type seedProduct struct {
+	id         string
+	seller     *seedUser
+	card       *seedCard
+	department string
+	quantity   int
+	price      float64
+	created    time.Time
+}
+
+func defaultSeedConfig() seedConfig {
+	return seedConfig{Users: 50, Sellers: 10, Products: 100, Orders: 200, Reviews: 80, Balance: 1000, Days: 30, Seed: 1}
+}
+
+func seedCommand(args []string) error {
+	cfg := defaultSeedConfig()
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	flags.IntVar(&cfg.Users, "users", cfg.Users, "number of users")
+	flags.IntVar(&cfg.Sellers, "sellers", cfg.Sellers, "users that list products")
+	flags.IntVar(&cfg.Products, "products", cfg.Products, "number of listings")
+	flags.IntVar(&cfg.Orders, "orders", cfg.Orders, "number of orders")
+	flags.IntVar(&cfg.Reviews, "reviews", cfg.Reviews, "number of reviews, written by buyers of the product")
+	flags.Float64Var(&cfg.Balance, "balance", cfg.Balance, "average starting balance of a card")
+	flags.IntVar(&cfg.Days, "days", cfg.Days, "days of history to spread the data over")
+	flags.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed, equal seeds generate equal data")
+	flags.StringVar(&cfg.World, "world", cfg.World, "id or name of the world to fill")
+	flags.Parse(args)
+	if cfg.Users < 1 || cfg.Sellers < 1 || cfg.Sellers > cfg.Users || cfg.Products < 0 || cfg.Orders < 0 || cfg.Reviews < 0 || cfg.Days < 1 {
+		return fmt.Errorf("seed needs at least one user and one seller, no more sellers than users and at least one day")
+	}
+
+	db, rdb := connect()
+	stats, err := seedWorld(context.Background(), cfg, db, rdb)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(stats, "", "    ")
+	fmt.Println(string(out))
+	return nil
+}
+
+// writes the whole dataset in one transaction, then counts the orders towards bestsellers and the leaderboard
+func seedWorld(ctx context.Context, cfg seedConfig, db *sql.DB, rdb *redis.Client) (seedStats, error) {
+	stats := seedStats{}
+	world, err := findWorld(db, cfg.World)
+	if err != nil {
+		return stats, fmt.Errorf("world %q: %w", cfg.World, err)
+	}
+	stats.World = world
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	now := clock.Now()
+	start := now.Add(-time.Duration(cfg.Days) * 24 * time.Hour)
+	//random moment between from and now
+	at := func(from time.Time) time.Time {
+		if span := now.Sub(from); span > 0 {
+			return from.Add(time.Duration(rng.Int63n(int64(span))))
+		}
+		return now
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	users := make([]*seedUser, 0, cfg.Users)
+	numbers := map[string]bool{}
+	for i := 0; i < cfg.Users; i++ {
+		first, last := firstNames[rng.Intn(len(firstNames))], lastNames[rng.Intn(len(lastNames))]
+		//users join during the first half of the history so they have time to trade
+		user := &seedUser{created: start.Add(time.Duration(rng.Int63n(int64(now.Sub(start)/2) + 1)))}
+		email := fmt.Sprintf("%s.%s.%d.%d@seed.local", first, last, cfg.Seed, i+1)
+		address := fmt.Sprintf("%d %s", 1+rng.Intn(999), streets[rng.Intn(len(streets))])
+		if err := tx.QueryRowContext(ctx, "INSERT INTO Users(name, email, address, status, created, world_id) VALUES($1, $2, $3, 'A', $4, $5)"+
+			" RETURNING id;", first+" "+last, email, address, user.created, world).Scan(&user.id); err != nil {
+			return stats, fmt.Errorf("user %s: %w", email, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO Firebase(uid, id, world_id) VALUES($1, $2, $3);",
+			fmt.Sprintf("seed-%d-%d", cfg.Seed, i+1), user.id, world); err != nil {
+			return stats, err
+		}
+		if _, err := tx.ExecContext(ctx, defaultRolesQuery, user.id, user.created); err != nil {
+			return stats, err
+		}
+		cards := 1 + rng.Intn(2)
+		for j := 0; j < cards; j++ {
+			number := fmt.Sprintf("%012d", rng.Int63n(1e12))
+			for numbers[number] {
+				number = fmt.Sprintf("%012d", rng.Int63n(1e12))
+			}
+			numbers[number] = true
+			card := seedCard{balance: math.Round(cfg.Balance*(0.5+rng.Float64())*100) / 100}
+			if err := tx.QueryRowContext(ctx, "INSERT INTO Cards(user_id, number, code, balance, created, world_id) VALUES($1, $2, $3, $4, $5, $6)"+
+				" RETURNING id;", user.id, number, fmt.Sprintf("%04d", rng.Intn(1e4)), card.balance, user.created, world).Scan(&card.id); err != nil {
+				return stats, err
+			}
+			user.cards = append(user.cards, card)
+			stats.Cards++
+		}
+		users = append(users, user)
+		stats.Users++
+	}
+
+	sellers := users[:cfg.Sellers]
+	products := make([]*seedProduct, 0, cfg.Products)
+	for i := 0; i < cfg.Products; i++ {
+		seller := sellers[rng.Intn(len(sellers))]
+		department := departments[rng.Intn(len(departments))]
+		names := catalog[department]
+		name := adjectives[rng.Intn(len(adjectives))] + " " + names[rng.Intn(len(names))]
+		description := descriptions[rng.Intn(len(descriptions))]
+		product := &seedProduct{
+			seller:     seller,
+			card:       &seller.cards[rng.Intn(len(seller.cards))],
+			department: department,
+			quantity:   5 + rng.Intn(46),
+			price:      math.Round(basePrices[department]*(0.5+rng.Float64())*100) / 100,
+			created:    at(seller.created),
+		}
+		if err := tx.QueryRowContext(ctx, "INSERT INTO Products(card_id, name, description, department, quantity, price, status, created, world_id)"+
+			" VALUES($1, $2, $3, $4, $5, $6, 'A', $7, $8) RETURNING id;", product.card.id, name, strings.ReplaceAll(description, "{name}", name), department,
+			product.quantity, product.price, product.created, world).Scan(&product.id); err != nil {
+			return stats, err
+		}
+		products = append(products, product)
+		stats.Products++
+	}
+
+	type sale struct {
+		product  *seedProduct
+		quantity int64
+		revenue  float64
+	}
+	var sales []sale
+	type purchase struct {
+		buyer   *seedUser
+		product *seedProduct
+		after   time.Time
+	}
+	var purchases []purchase
+	reviewed := map[[2]string]bool{}
+	//buyers that cannot afford their pick or picked their own listing skip the attempt
+	for attempt := 0; attempt < cfg.Orders*3 && stats.Orders < cfg.Orders && len(products) > 0; attempt++ {
+		buyer := users[rng.Intn(len(users))]
+		product := products[rng.Intn(len(products))]
+		card := &buyer.cards[rng.Intn(len(buyer.cards))]
+		quantity := 1 + rng.Intn(3)
+		if product.seller == buyer || product.quantity < quantity || card.balance < float64(quantity)*product.price {
+			continue
+		}
+		cost := math.Round(float64(quantity)*product.price*100) / 100
+		created := at(maxTime(buyer.created, product.created))
+		if _, err := tx.ExecContext(ctx, "INSERT INTO Orders(card_id, product_id, quantity, price, status, created, world_id) VALUES($1, $2, $3, $4, 'A', $5, $6);",
+			card.id, product.id, quantity, product.price, created, world); err != nil {
+			return stats, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE Cards SET balance = balance - $1 WHERE id = $2;", cost, card.id); err != nil {
+			return stats, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE Cards SET balance = balance + $1 WHERE id = $2;", cost, product.card.id); err != nil {
+			return stats, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE Products SET quantity = quantity - $1 WHERE id = $2;", quantity, product.id); err != nil {
+			return stats, err
+		}
+		card.balance -= cost
+		product.card.balance += cost
+		product.quantity -= quantity
+		sales = append(sales, sale{product, int64(quantity), cost})
+		purchases = append(purchases, purchase{buyer, product, created})
+		stats.Orders++
+		stats.Volume += cost
+	}
+
+	//at most one review per buyer and product, written after the purchase
+	for _, i := range rng.Perm(len(purchases)) {
+		if stats.Reviews == cfg.Reviews {
+			break
+		}
+		p := purchases[i]
+		key := [2]string{p.buyer.id, p.product.id}
+		if reviewed[key] {
+			continue
+		}
+		reviewed[key] = true
+		rating := seedRating(rng)
+		texts := reviewTexts[rating]
+		if _, err := tx.ExecContext(ctx, "INSERT INTO Reviews(user_id, review, rating, product_id, created) VALUES($1, $2, $3, $4, $5);",
+			p.buyer.id, texts[rng.Intn(len(texts))], rating, p.product.id, at(p.after)); err != nil {
+			return stats, err
+		}
+		stats.Reviews++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return stats, err
+	}
+	for _, s := range sales {
+		salesRecord(ctx, rdb, world, s.product.id, s.product.department, s.product.seller.id, s.quantity, s.revenue)
+	}
+	searchCache.Invalidate(ctx, rdb, world)
+	stats.Volume = math.Round(stats.Volume*100) / 100
+	return stats, nil
+}
+
+// ratings lean positive like on most stores
+func seedRating(rng *rand.Rand) int {
+	switch n := rng.Intn(100); {
+	case n < 5:
+		return 1
+	case n < 12:
+		return 2
+	case n < 30:
+		return 3
+	case n < 65:
+		return 4
+	default:
+		return 5
+	}
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// listens on server.host:server.port (localhost:8000 by default), the server timeouts bound slow clients
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(settings.Server.Host, strconv.Itoa(settings.Server.Port)),
+		Handler:           handler,
+		ReadHeaderTimeout: settings.Server.ReadHeaderTimeout,
+		ReadTimeout:       settings.Server.ReadTimeout,
+		WriteTimeout:      settings.Server.WriteTimeout,
+		IdleTimeout:       settings.Server.IdleTimeout,
+	}
+}
+
+// serves until SIGINT or SIGTERM, then stops accepting connections and waits
+// up to server.shutdownTimeout (30s by default) for the requests in flight.
+// errors are failures to serve such as a port in use, requests cut off by the timeout are only logged
+func serve(server *http.Server) error {
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	failed := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", server.Addr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+	select {
+	case err := <-failed:
+		return err
+	case <-stop.Done():
+	}
+	log.Printf("shutting down, draining requests")
+	ctx, done := context.WithTimeout(context.Background(), settings.Server.ShutdownTimeout)
+	defer done()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("requests cut off after %s: %v", settings.Server.ShutdownTimeout, err)
+	}
+	return nil
+}
+
+// background jobs that share a context and are waited for when they are stopped
+type workers struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+func (w *workers) start(job func(ctx context.Context)) {
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		job(w.ctx)
+	}()
+}
+
+func (w *workers) stop() {
+	w.cancel()
+	w.running.Wait()
+}
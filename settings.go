@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"example/ecommsimapis/config"
+)
+
+// settings of the process, loaded once in main before anything reads them
+var settings = config.Default()
+
+// loads and validates the settings and applies the ones that configure shared state such as the clock
+func loadSettings(overrides *config.Overrides) error {
+	loaded, err := config.Load(overrides)
+	if err != nil {
+		return err
+	}
+	settings = loaded
+	clock.Set(settings.Clock.Mode, settings.Clock.Rate)
+	return nil
+}
+
+// `server config check [-config file] [-server.port 8080 ...]` prints the redacted settings and every problem with them
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: config check [-config file] [-<setting> value ...]")
+	}
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	overrides := config.Flags(flags)
+	flags.Parse(args[1:])
+	loaded, err := config.Load(overrides)
+	fmt.Print(loaded)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	fmt.Fprintln(os.Stderr, "configuration ok")
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// product names by department, used to generate listings for simulated sellers
+var catalog = map[string][]string{
+	"electronics": {"Headphones", "Charger", "Keyboard", "Monitor", "Speaker", "Webcam"},
+	"home":        {"Lamp", "Blanket", "Mug", "Vase", "Pillow", "Clock"},
+	"clothing":    {"Jacket", "Sneakers", "Scarf", "Hoodie", "Cap", "Socks"},
+	"books":       {"Novel", "Cookbook", "Atlas", "Notebook", "Biography", "Comic"},
+	"toys":        {"Puzzle", "Kite", "Robot", "Yo-yo", "Board Game", "Plush Bear"},
+	"grocery":     {"Coffee", "Olive Oil", "Honey", "Tea", "Chocolate", "Granola"},
+}
+
+// departments in a fixed order so runs with the same seed make the same choices
+var departments = []string{"books", "clothing", "electronics", "grocery", "home", "toys"}
+
+var adjectives = []string{"Classic", "Deluxe", "Compact", "Vintage", "Eco", "Premium", "Everyday", "Handmade"}
+
+// base prices per department, listings vary around them
+var basePrices = map[string]float64{
+	"electronics": 60, "home": 25, "clothing": 35, "books": 15, "toys": 20, "grocery": 8,
+}
+
+type simConfig struct {
+	Buyers   int
+	Sellers  int
+	Products int     //listings per seller
+	Budget   float64 //starting balance of each buyer
+	Rounds   int     //0 runs until cancelled
+	Interval time.Duration
+	Seed     int64
+	World    string //id or name, the default world if empty
+	//departments agents pick their preferences from, all of them if empty
+	Departments []string
+}
+
+func defaultSimConfig() simConfig {
+	return simConfig{Buyers: 20, Sellers: 5, Products: 4, Budget: 500, Rounds: 50, Interval: time.Second, Seed: 1}
+}
+
+// the server runs agents in-process when simulation.buyers is set, until it stops unless simulation.rounds is set
+func simConfigFromSettings() (simConfig, bool) {
+	sim := settings.Simulation
+	return simConfig{Buyers: sim.Buyers, Sellers: sim.Sellers, Products: sim.Products, Budget: sim.Budget, Rounds: sim.Rounds,
+		Interval: sim.Interval, Seed: sim.Seed, World: sim.World}, sim.Buyers > 0
+}
+
+func simulateCommand(args []string) error {
+	cfg := defaultSimConfig()
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	flags.IntVar(&cfg.Buyers, "buyers", cfg.Buyers, "number of simulated buyers")
+	flags.IntVar(&cfg.Sellers, "sellers", cfg.Sellers, "number of simulated sellers")
+	flags.IntVar(&cfg.Products, "products", cfg.Products, "listings per seller")
+	flags.Float64Var(&cfg.Budget, "budget", cfg.Budget, "starting balance of each buyer")
+	flags.IntVar(&cfg.Rounds, "rounds", cfg.Rounds, "rounds to run, 0 runs until interrupted")
+	flags.DurationVar(&cfg.Interval, "interval", cfg.Interval, "pause between rounds")
+	flags.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed, equal seeds make equal choices")
+	flags.StringVar(&cfg.World, "world", cfg.World, "id or name of the world the agents live in")
+	flags.Parse(args)
+
+	db, rdb := connect()
+	events := newEventRecorder(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	go events.run(ctx)
+	//SIGINT ends the rounds, the recorder still flushes what they recorded
+	stop, interrupted := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	stats, err := runSimulation(stop, cfg, db, rdb, events)
+	interrupted()
+	cancel()
+	<-events.done
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(stats, "", "    ")
+	fmt.Println(string(out))
+	return nil
+}
+
+type simAgent struct {
+	id          string
+	card        string
+	code        string
+	balance     float64
+	departments []string
+	maxPrice    float64
+}
+
+type simStats struct {
+	Buyers   int     `json:"buyers"`
+	Sellers  int     `json:"sellers"`
+	Listings int     `json:"listings"`
+	Searches int     `json:"searches"`
+	Orders   int     `json:"orders"`
+	Rejected int     `json:"rejected"`
+	Restocks int     `json:"restocks"`
+	Spent    float64 `json:"spent"`
+}
+
+type simulation struct {
+	cfg     simConfig
+	db      *sql.DB
+	rdb     *redis.Client
+	events  *eventRecorder
+	rng     *rand.Rand
+	run     string
+	cards   int64 //offset of the card numbers of this run
+	buyers  []*simAgent
+	sellers []*simAgent
+	stats   simStats
+}
+
+// creates the agents and runs rounds of shopping until cfg.Rounds is reached or ctx is cancelled
+func runSimulation(ctx context.Context, cfg simConfig, db *sql.DB, rdb *redis.Client, events *eventRecorder) (simStats, error) {
+	started := time.Now()
+	sim := &simulation{
+		cfg:    cfg,
+		db:     db,
+		rdb:    rdb,
+		events: events,
+		rng:    rand.New(rand.NewSource(cfg.Seed)),
+		run:    strconv.FormatInt(started.Unix(), 36),
+		cards:  started.UnixNano() % 1e12,
+	}
+	world, err := findWorld(db, cfg.World)
+	if err != nil {
+		log.Printf("simulation world %q not found: %v", cfg.World, err)
+		return sim.stats, err
+	}
+	sim.cfg.World = world
+	if err := sim.setup(); err != nil {
+		log.Printf("simulation setup failed: %v", err)
+		return sim.stats, err
+	}
+	for round := 0; cfg.Rounds == 0 || round < cfg.Rounds; round++ {
+		sim.round()
+		select {
+		case <-ctx.Done():
+			return sim.stats, nil
+		case <-time.After(cfg.Interval):
+		}
+	}
+	return sim.stats, nil
+}
+
+func (sim *simulation) setup() error {
+	for i := 0; i < sim.cfg.Sellers; i++ {
+		seller, err := sim.agent("seller", i, 0)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < sim.cfg.Products; j++ {
+			sim.list(seller)
+		}
+		sim.sellers = append(sim.sellers, seller)
+		sim.stats.Sellers++
+	}
+	for i := 0; i < sim.cfg.Buyers; i++ {
+		buyer, err := sim.agent("buyer", i, sim.cfg.Budget*(0.5+sim.rng.Float64()))
+		if err != nil {
+			return err
+		}
+		sim.buyers = append(sim.buyers, buyer)
+		sim.stats.Buyers++
+	}
+	return nil
+}
+
+// inserts a user without a Firebase account with their roles and a funded card in one transaction,
+// so a failed agent leaves nothing behind
+func (sim *simulation) agent(role string, n int, balance float64) (*simAgent, error) {
+	agent := &simAgent{
+		//the run is mixed in so repeated runs with the same seed in a world don't reuse card numbers
+		card:     fmt.Sprintf("%012d", (sim.cards+sim.rng.Int63n(1e12))%1e12),
+		code:     fmt.Sprintf("%04d", sim.rng.Intn(1e4)),
+		balance:  balance,
+		maxPrice: 20 + sim.rng.Float64()*180,
+	}
+	choices := departments
+	if len(sim.cfg.Departments) > 0 {
+		choices = sim.cfg.Departments
+	}
+	for _, i := range sim.rng.Perm(len(choices))[:1+sim.rng.Intn(min(3, len(choices)))] {
+		agent.departments = append(agent.departments, choices[i])
+	}
+	name := fmt.Sprintf("Sim %s %d", role, n+1)
+	email := fmt.Sprintf("sim-%s-%d-%s%d@sim.local", sim.run, sim.cfg.Seed, role, n+1)
+	tx, err := sim.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow("INSERT INTO Users(name, email, status, created, world_id) VALUES($1, $2, 'A', $3, $4) RETURNING id;",
+		name, email, clock.Now(), sim.world()).Scan(&agent.id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(defaultRolesQuery, agent.id, clock.Now()); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO Cards(user_id, number, code, balance, created, world_id) VALUES($1, $2, $3, $4, $5, $6);",
+		agent.id, agent.card, agent.code, strconv.FormatFloat(balance, 'f', 2, 64), clock.Now(), sim.world()); err != nil {
+		return nil, fmt.Errorf("simulated card creation failed: %w", err)
+	}
+	return agent, tx.Commit()
+}
+
+func (sim *simulation) list(seller *simAgent) {
+	department := seller.departments[sim.rng.Intn(len(seller.departments))]
+	names := catalog[department]
+	name := adjectives[sim.rng.Intn(len(adjectives))] + " " + names[sim.rng.Intn(len(names))]
+	price := basePrices[department] * (0.5 + sim.rng.Float64())
+	status, _ := sim.request(func(c *gin.Context) { productPost(c, sim.db, sim.rdb) }, seller, http.MethodPost, "/products", nil, gin.H{
+		"card":        seller.card,
+		"code":        seller.code,
+		"name":        name,
+		"description": "A " + name + " listed by a simulated seller.",
+		"department":  department,
+		"quantity":    strconv.Itoa(5 + sim.rng.Intn(20)),
+		"price":       strconv.FormatFloat(price, 'f', 2, 64),
+	})
+	if status == http.StatusCreated {
+		sim.stats.Listings++
+	}
+}
+
+func (sim *simulation) round() {
+	for _, buyer := range sim.buyers {
+		sim.shop(buyer)
+	}
+	for _, seller := range sim.sellers {
+		sim.restock(seller)
+	}
+}
+
+// searches a preferred department and orders something affordable
+func (sim *simulation) shop(buyer *simAgent) {
+	department := buyer.departments[sim.rng.Intn(len(buyer.departments))]
+	status, body := sim.request(func(c *gin.Context) { productSearch(c, sim.db, sim.rdb, sim.events) }, buyer, http.MethodGet,
+		"/products?department="+department+"&sort=price&sortType=1", nil, nil)
+	sim.stats.Searches++
+	if status != http.StatusOK {
+		return
+	}
+	var results struct {
+		Products []struct {
+			Id       string `json:"id"`
+			Quantity string `json:"quantity"`
+			Price    string `json:"price"`
+		} `json:"products"`
+	}
+	if err := json.Unmarshal(body, &results); err != nil {
+		return
+	}
+	type candidate struct {
+		id       string
+		price    float64
+		quantity int
+	}
+	var affordable []candidate
+	for _, p := range results.Products {
+		price, priceErr := strconv.ParseFloat(p.Price, 64)
+		quantity, quantityErr := strconv.Atoi(p.Quantity)
+		if priceErr == nil && quantityErr == nil && quantity > 0 && price <= buyer.maxPrice && price <= buyer.balance {
+			affordable = append(affordable, candidate{p.Id, price, quantity})
+		}
+	}
+	if len(affordable) == 0 {
+		return
+	}
+	pick := affordable[sim.rng.Intn(len(affordable))]
+	quantity := 1 + sim.rng.Intn(3)
+	for quantity > 1 && (quantity > pick.quantity || float64(quantity)*pick.price > buyer.balance) {
+		quantity--
+	}
+	status, _ = sim.request(func(c *gin.Context) { orderPost(c, sim.db, sim.rdb, sim.events) }, buyer, http.MethodPost, "/orders", nil, gin.H{
+		"card":     buyer.card,
+		"code":     buyer.code,
+		"product":  pick.id,
+		"quantity": strconv.Itoa(quantity),
+	})
+	if status != http.StatusCreated {
+		sim.stats.Rejected++
+		return
+	}
+	cost := float64(quantity) * pick.price
+	buyer.balance -= cost
+	sim.stats.Orders++
+	sim.stats.Spent += cost
+}
+
+// refills sold out listings through productPatch
+func (sim *simulation) restock(seller *simAgent) {
+	rows, err := sim.db.Query("SELECT Products.id FROM Products JOIN Cards ON Products.card_id = Cards.id"+
+		" WHERE Cards.user_id = $1 AND Products.status = 'A' AND Products.quantity = 0 ORDER BY Products.id;", seller.id)
+	if err != nil {
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		status, _ := sim.request(func(c *gin.Context) { productPatch(c, sim.db, sim.rdb) }, seller, http.MethodPatch, "/products/"+id,
+			gin.Params{{Key: "id", Value: id}}, gin.H{"code": seller.code, "quantity": strconv.Itoa(5 + sim.rng.Intn(20))})
+		if status == http.StatusOK {
+			sim.stats.Restocks++
+		}
+	}
+}
+
+// runs a handler in-process as the agent, the same way the router would after authentication
+func (sim *simulation) request(handler gin.HandlerFunc, agent *simAgent, method string, target string, params gin.Params, body any) (int, []byte) {
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		reader = bytes.NewReader(buf)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, reader)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = params
+	c.Set(userKey, agent.id)
+	c.Set("world", sim.world())
+	handler(c)
+	return c.Writer.Status(), w.Body.Bytes()
+}
+
+func (sim *simulation) world() string {
+	if sim.cfg.World == "" {
+		return defaultWorld
+	}
+	return sim.cfg.World
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"example/ecommsimapis/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// every table of every world, parents before children so rows can be inserted in order
+var snapshotTables = []struct {
+	name   string
+	serial bool
+}{
+	{"Worlds", true},
+	{"Users", true},
+	{"Firebase", false},
+	{"Cards", true},
+	{"Products", true},
+	{"Orders", true},
+	{"Reviews", true},
+	{"ReviewVotes", false},
+	{"ReviewReplies", false},
+	{"Wishlists", true},
+	{"WishlistItems", false},
+	{"Events", true},
+	{"EconomySnapshots", true},
+	{"DepartmentSnapshots", false},
+	{"PricingRules", false},
+	{"PriceChanges", true},
+	{"UserRoles", false},
+	{"RoleChanges", true},
+	{"Bans", true},
+	{"BanAppeals", true},
+}
+
+// sorted sets that only live in Redis
+var snapshotKeyPatterns = []string{"trending:*", "bestsellers:*", "leaderboard:*"}
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type snapshotFile struct {
+	Name       string                       `json:"name"`
+	Taken      time.Time                    `json:"taken"`
+	Tables     map[string]json.RawMessage   `json:"tables"`
+	SortedSets map[string]snapshotSortedSet `json:"sortedSets"`
+}
+
+type snapshotSortedSet struct {
+	TTL     time.Duration `json:"ttl"`
+	Members []redis.Z     `json:"members"`
+}
+
+// named snapshots live in snapshots.dir, anything ending in .json is taken as a path
+func snapshotPath(name string) (string, error) {
+	if strings.HasSuffix(name, ".json") {
+		return name, nil
+	}
+	if !snapshotName.MatchString(name) {
+		return "", errors.New("snapshot names may only contain letters, digits, - and _")
+	}
+	return filepath.Join(settings.Snapshots.Dir, name+".json"), nil
+}
+
+func saveSnapshot(ctx context.Context, db *sql.DB, rdb *redis.Client, name string) (string, error) {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return "", err
+	}
+	snapshot := snapshotFile{Name: name, Taken: clock.Now(), Tables: map[string]json.RawMessage{}, SortedSets: map[string]snapshotSortedSet{}}
+
+	//one repeatable read transaction so the tables agree with each other
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	for _, table := range snapshotTables {
+		var rows []byte
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(json_agg(t), '[]') FROM "+table.name+" AS t;").Scan(&rows); err != nil {
+			return "", fmt.Errorf("%s: %w", table.name, err)
+		}
+		snapshot.Tables[table.name] = rows
+	}
+
+	for _, pattern := range snapshotKeyPatterns {
+		keys, err := scanKeys(ctx, rdb, pattern)
+		if err != nil {
+			return "", err
+		}
+		for _, key := range keys {
+			members, err := rdb.ZRangeWithScores(ctx, key, 0, -1).Result()
+			if err != nil {
+				return "", err
+			}
+			ttl, _ := rdb.PTTL(ctx, key).Result()
+			snapshot.SortedSets[key] = snapshotSortedSet{TTL: max(ttl, 0), Members: members}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, buf, 0o644)
+}
+
+// actor is the admin restoring over HTTP, empty for the command
+func restoreSnapshot(ctx context.Context, db *sql.DB, rdb *redis.Client, name string, actor string) error {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snapshot snapshotFile
+	if err := json.Unmarshal(buf, &snapshot); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	replaced, err := worldIds(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := truncateWorld(ctx, tx); err != nil {
+		return err
+	}
+	for _, table := range snapshotTables {
+		rows, ok := snapshot.Tables[table.name]
+		if !ok {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+table.name+" SELECT * FROM json_populate_recordset(NULL::"+table.name+", $1);",
+			string(rows)); err != nil {
+			return fmt.Errorf("%s: %w", table.name, err)
+		}
+		if table.serial {
+			if _, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('"+table.name+"', 'id'), COALESCE(MAX(id), 1),"+
+				" MAX(id) IS NOT NULL) FROM "+table.name+";"); err != nil {
+				return fmt.Errorf("%s: %w", table.name, err)
+			}
+		}
+	}
+	restored, err := worldIds(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, world := range append(replaced, restored...) {
+		if err := audit(ctx, tx, world, actor, auditSnapshotRestore, "snapshot", name, nil, nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := flushWorldKeys(ctx, rdb); err != nil {
+		return err
+	}
+	pipe := rdb.Pipeline()
+	for key, set := range snapshot.SortedSets {
+		if len(set.Members) == 0 {
+			continue
+		}
+		pipe.ZAdd(ctx, key, set.Members...)
+		if set.TTL > 0 {
+			pipe.PExpire(ctx, key, set.TTL)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// empties every table and the related Redis keys, optionally listing simulated sellers and products afterwards.
+// keep is the admin resetting over HTTP, moved to the default world with their accounts and roles so they are not locked out
+func resetWorld(ctx context.Context, db *sql.DB, rdb *redis.Client, seeded bool, keep string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var user, accounts, roles string
+	if keep != "" {
+		if err := tx.QueryRowContext(ctx, "SELECT row_to_json(Users), (SELECT COALESCE(json_agg(Firebase), '[]') FROM Firebase WHERE id = Users.id),"+
+			" (SELECT COALESCE(json_agg(UserRoles), '[]') FROM UserRoles WHERE user_id = Users.id) FROM Users WHERE id = $1;", keep).
+			Scan(&user, &accounts, &roles); err != nil {
+			return err
+		}
+	}
+	replaced, err := worldIds(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err := truncateWorld(ctx, tx); err != nil {
+		return err
+	}
+	//the default world always exists
+	if _, err := tx.ExecContext(ctx, "INSERT INTO Worlds(id, name, created) VALUES($1, 'default', $2);", defaultWorld, clock.Now()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('worlds', 'id'), 1);"); err != nil {
+		return err
+	}
+	if keep != "" {
+		for _, restore := range []struct {
+			query string
+			args  []any
+		}{
+			{"INSERT INTO Users SELECT * FROM jsonb_populate_record(NULL::Users, $1::jsonb || jsonb_build_object('world_id', $2::int));", []any{user, defaultWorld}},
+			{"INSERT INTO Firebase SELECT * FROM json_populate_recordset(NULL::Firebase, $1);", []any{accounts}},
+			{"UPDATE Firebase SET world_id = $1;", []any{defaultWorld}},
+			{"INSERT INTO UserRoles SELECT * FROM json_populate_recordset(NULL::UserRoles, $1);", []any{roles}},
+			{"SELECT setval(pg_get_serial_sequence('users', 'id'), $1);", []any{keep}},
+		} {
+			if _, err := tx.ExecContext(ctx, restore.query, restore.args...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, world := range replaced {
+		if err := audit(ctx, tx, world, keep, auditWorldReset, "world", "*", nil, map[string]any{"seeded": seeded}); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := flushWorldKeys(ctx, rdb); err != nil {
+		return err
+	}
+	if !seeded {
+		return nil
+	}
+	cfg := defaultSimConfig()
+	cfg.Buyers = 0
+	sim := &simulation{cfg: cfg, db: db, rdb: rdb, rng: rand.New(rand.NewSource(cfg.Seed)), run: "reset"}
+	return sim.setup()
+}
+
+// ids of every world, resets and restores log an entry in each world they replace so its epoch moves
+// even when the id is created again later
+func worldIds(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM Worlds ORDER BY id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func truncateWorld(ctx context.Context, tx *sql.Tx) error {
+	names := make([]string, 0, len(snapshotTables))
+	for _, table := range snapshotTables {
+		names = append(names, table.name)
+	}
+	_, err := tx.ExecContext(ctx, "TRUNCATE "+strings.Join(names, ", ")+" RESTART IDENTITY CASCADE;")
+	return err
+}
+
+// the sorted sets and every cached value, which may describe rows that no longer exist
+func flushWorldKeys(ctx context.Context, rdb *redis.Client) error {
+	var keys []string
+	for _, pattern := range append(snapshotKeyPatterns, cache.Pattern) {
+		matched, err := scanKeys(ctx, rdb, pattern)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, matched...)
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), 500)
+		if err := rdb.Del(ctx, keys[:n]...).Err(); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func scanKeys(ctx context.Context, rdb *redis.Client, pattern string) ([]string, error) {
+	var keys []string
+	iter := rdb.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func listSnapshots() ([]string, error) {
+	dir := settings.Snapshots.Dir
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// snapshot save <name>, snapshot restore <name>, snapshot reset [-seeded], snapshot list
+func snapshotCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: snapshot save|restore|reset|list")
+	}
+	if args[0] == "list" {
+		names, err := listSnapshots()
+		if err != nil {
+			return err
+		}
+		fmt.Println(strings.Join(names, "\n"))
+		return nil
+	}
+	flags := flag.NewFlagSet("snapshot "+args[0], flag.ExitOnError)
+	seeded := flags.Bool("seeded", false, "list simulated sellers and products after resetting")
+	flags.Parse(args[1:])
+
+	db, rdb := connect()
+	ctx := context.Background()
+	switch args[0] {
+	case "save", "restore":
+		if flags.NArg() != 1 {
+			return errors.New("usage: snapshot " + args[0] + " <name>")
+		}
+		if args[0] == "restore" {
+			return restoreSnapshot(ctx, db, rdb, flags.Arg(0), "")
+		}
+		path, err := saveSnapshot(ctx, db, rdb, flags.Arg(0))
+		if err == nil {
+			fmt.Println(path)
+		}
+		return err
+	case "reset":
+		return resetWorld(ctx, db, rdb, *seeded, "")
+	default:
+		return errors.New("usage: snapshot save|restore|reset|list")
+	}
+}
+
+func snapshotsGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	names, err := listSnapshots()
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"snapshots": names})
+}
+
+func snapshotPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var snapshot struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.BindJSON(&snapshot); err != nil {
+		return
+	}
+	if !snapshotName.MatchString(snapshot.Name) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if _, err := saveSnapshot(c.Request.Context(), db, rdb, snapshot.Name); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusCreated)
+}
+
+func snapshotRestorePost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	name, exists := c.Params.Get("name")
+	if !exists || !snapshotName.MatchString(name) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	admin, _ := c.Get(userKey)
+	err := restoreSnapshot(c.Request.Context(), db, rdb, name, admin.(string))
+	if errors.Is(err, os.ErrNotExist) {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func resetPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var reset struct {
+		Seeded bool `json:"seeded"`
+	}
+	if err := c.BindJSON(&reset); err != nil {
+		return
+	}
+	admin, _ := c.Get(userKey)
+	if err := resetWorld(c.Request.Context(), db, rdb, reset.Seeded, admin.(string)); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
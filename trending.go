@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// trending scores are kept in time bucketed sorted sets and summed over the window when read
+var trendingWindows = map[string]struct {
+	bucket time.Duration
+	count  int
+}{
+	"hour": {5 * time.Minute, 12},
+	"day":  {time.Hour, 24},
+	"week": {time.Hour, 168},
+}
+
+// bucket sizes and how long buckets are kept, enough to cover the longest window using them
+var trendingBuckets = map[time.Duration]time.Duration{
+	5 * time.Minute: 2 * time.Hour,
+	time.Hour:       8 * 24 * time.Hour,
+}
+
+const (
+	trendingViewScore     = 1
+	trendingPurchaseScore = 5
+)
+
+// every key carries the world so rankings never mix worlds
+func trendingKey(world string, bucket time.Duration, t time.Time) string {
+	seconds := int64(bucket / time.Second)
+	return "trending:" + world + ":" + strconv.FormatInt(seconds, 10) + ":" + strconv.FormatInt(t.Unix()/seconds, 10)
+}
+
+func bestsellersKey(world string, department string) string {
+	return "bestsellers:" + world + ":" + department
+}
+
+func leaderboardSellersKey(world string) string {
+	return "leaderboard:" + world + ":sellers"
+}
+
+func trendingRecord(ctx context.Context, rdb *redis.Client, world string, productId string, score float64) {
+	now := clock.Now()
+	pipe := rdb.Pipeline()
+	for bucket, keep := range trendingBuckets {
+		key := trendingKey(world, bucket, now)
+		pipe.ZIncrBy(ctx, key, score, productId)
+		pipe.Expire(ctx, key, keep)
+	}
+	pipe.Exec(ctx)
+}
+
+// counts units sold per department and revenue per seller
+func salesRecord(ctx context.Context, rdb *redis.Client, world string, productId string, department string, seller string, quantity int64, revenue float64) {
+	pipe := rdb.Pipeline()
+	pipe.ZIncrBy(ctx, bestsellersKey(world, department), float64(quantity), productId)
+	pipe.ZIncrBy(ctx, leaderboardSellersKey(world), revenue, seller)
+	pipe.Exec(ctx)
+}
+
+func trendingGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	name := c.DefaultQuery("window", "day")
+	window, ok := trendingWindows[name]
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, _, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	now := clock.Now()
+	keys := make([]string, 0, window.count)
+	for i := 0; i < window.count; i++ {
+		keys = append(keys, trendingKey(worldOf(c), window.bucket, now.Add(-time.Duration(i)*window.bucket)))
+	}
+	scores, err := rdb.ZUnionWithScores(c.Request.Context(), redis.ZStore{Keys: keys}).Result()
+	if unavailable(c, redisBreaker, err) {
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	ids := make([]string, 0, limit)
+	for _, z := range scores {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, z.Member.(string))
+	}
+	productListResponse(c, db, ids)
+}
+
+func bestsellersGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	department := c.Query("department")
+	if department == "" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	limit, _, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	ids, err := rdb.ZRevRange(c.Request.Context(), bestsellersKey(worldOf(c), department), 0, int64(limit-1)).Result()
+	if unavailable(c, redisBreaker, err) {
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	productListResponse(c, db, ids)
+}
+
+func leaderboardGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	limit, offset, ok := paginate(c)
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	scores, err := rdb.ZRevRangeWithScores(c.Request.Context(), leaderboardSellersKey(worldOf(c)), int64(offset), int64(offset+limit-1)).Result()
+	if unavailable(c, redisBreaker, err) {
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	ids := make([]string, 0, len(scores))
+	for _, z := range scores {
+		ids = append(ids, z.Member.(string))
+	}
+	names := map[string]string{}
+	rows, err := db.Query("SELECT id, COALESCE(name, '') FROM Users WHERE id::text = ANY($1);", pq.Array(ids))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		names[id] = name
+	}
+
+	type seller struct {
+		Rank    int    `json:"rank"`
+		Id      string `json:"id"`
+		Name    string `json:"name"`
+		Revenue string `json:"revenue"`
+	}
+	sellers := []seller{}
+	for i, z := range scores {
+		id := z.Member.(string)
+		sellers = append(sellers, seller{offset + i + 1, id, names[id], strconv.FormatFloat(z.Score, 'f', 2, 64)})
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"sellers": sellers})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+type wishlistItem struct {
+	Product  string `json:"product"`
+	Name     string `json:"name"`
+	Quantity string `json:"quantity"`
+	Price    string `json:"price"`
+	Status   string `json:"status"`
+	Active   bool   `json:"active"`
+	Removed  bool   `json:"removed"`
+	Added    string `json:"added"`
+}
+
+func wishlistsGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	var wishlists []struct {
+		Id     string `json:"id"`
+		Name   string `json:"name"`
+		Public bool   `json:"public"`
+		Share  string `json:"share,omitempty"`
+		Items  string `json:"items"`
+	}
+
+	rows, err := db.Query("SELECT Wishlists.id, Wishlists.name, Wishlists.public, COALESCE(Wishlists.share_token, ''),"+
+		" COUNT(WishlistItems.product_id) FROM Wishlists LEFT JOIN WishlistItems ON Wishlists.id = WishlistItems.wishlist_id"+
+		" WHERE Wishlists.user_id = $1 GROUP BY Wishlists.id ORDER BY Wishlists.created;", uid.(string))
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var wishlist struct {
+			Id     string `json:"id"`
+			Name   string `json:"name"`
+			Public bool   `json:"public"`
+			Share  string `json:"share,omitempty"`
+			Items  string `json:"items"`
+		}
+		if err := rows.Scan(&wishlist.Id, &wishlist.Name, &wishlist.Public, &wishlist.Share, &wishlist.Items); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		wishlists = append(wishlists, wishlist)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"wishlists": wishlists})
+}
+
+func wishlistPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	var wishlist struct {
+		Name   string `json:"name" binding:"required,max=64"`
+		Public bool   `json:"public"`
+	}
+	if err := c.BindJSON(&wishlist); err != nil {
+		return
+	}
+	var share sql.NullString
+	if wishlist.Public {
+		token, err := shareToken()
+		if err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		share = sql.NullString{String: token, Valid: true}
+	}
+
+	var id string
+	err := db.QueryRow("INSERT INTO Wishlists(user_id, name, public, share_token, created) VALUES($1, $2, $3, $4, $5)"+
+		" ON CONFLICT (user_id, name) DO NOTHING RETURNING id;", uid.(string), wishlist.Name, wishlist.Public, share, clock.Now()).Scan(&id)
+	if err == sql.ErrNoRows {
+		fail(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"id": id, "share": share.String})
+}
+
+// renames the wishlist or toggles sharing, making a list private revokes its link
+func wishlistPatch(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	wishlistId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var wishlist struct {
+		Name   string `json:"name" binding:"required,max=64"`
+		Public bool   `json:"public"`
+	}
+	if err := c.BindJSON(&wishlist); err != nil {
+		return
+	}
+	token, err := shareToken()
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	var share sql.NullString
+	err = db.QueryRow("UPDATE Wishlists SET name = $1, public = $2, share_token = CASE WHEN NOT $2 THEN NULL"+
+		" ELSE COALESCE(share_token, $3) END WHERE id = $4 AND user_id = $5 RETURNING share_token;",
+		wishlist.Name, wishlist.Public, token, wishlistId, uid.(string)).Scan(&share)
+	if err == sql.ErrNoRows {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusConflict, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"share": share.String})
+}
+
+func wishlistDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	wishlistId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM Wishlists WHERE id = $1 AND user_id = $2;", wishlistId, uid.(string))
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func wishlistGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	wishlistId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var name string
+	err := db.QueryRow("SELECT name FROM Wishlists WHERE id = $1 AND user_id = $2;", wishlistId, uid.(string)).Scan(&name)
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	items, err := wishlistItems(db, wishlistId)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"name": name, "items": items})
+}
+
+// public view of a shared wishlist, only reachable through its share link
+func wishlistSharedGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	token, exists := c.Params.Get("token")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var wishlistId string
+	var name string
+	var owner string
+	err := db.QueryRow("SELECT Wishlists.id, Wishlists.name, COALESCE(Users.name, '') FROM Wishlists JOIN Users"+
+		" ON Users.id = Wishlists.user_id WHERE Wishlists.share_token = $1 AND Wishlists.public AND Users.world_id = $2;", token, worldOf(c)).Scan(&wishlistId, &name, &owner)
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	items, err := wishlistItems(db, wishlistId)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"name": name, "owner": owner, "items": items})
+}
+
+func wishlistItemPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	wishlistId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var item struct {
+		Product string `json:"product" binding:"required,number"`
+	}
+	if err := c.BindJSON(&item); err != nil {
+		return
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM Products WHERE id = $1 AND world_id = $2;", item.Product, worldOf(c)).Scan(&status); err != nil || status != "A" {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO WishlistItems(wishlist_id, product_id, created) SELECT id, $1, $4 FROM Wishlists"+
+		" WHERE id = $2 AND user_id = $3 ON CONFLICT (wishlist_id, product_id) DO NOTHING;", item.Product, wishlistId, uid.(string), clock.Now())
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		//either the wishlist is not the user's or the product is already on it
+		var owned bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Wishlists WHERE id = $1 AND user_id = $2);",
+			wishlistId, uid.(string)).Scan(&owned); err != nil || !owned {
+			fail(c, http.StatusNotFound, err)
+			return
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Status(http.StatusCreated)
+}
+
+func wishlistItemDelete(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	uid, exists := c.Get(userKey)
+	if !exists {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	wishlistId, exists := c.Params.Get("id")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	productId, exists := c.Params.Get("product")
+	if !exists {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM WishlistItems USING Wishlists WHERE WishlistItems.wishlist_id = Wishlists.id"+
+		" AND Wishlists.id = $1 AND Wishlists.user_id = $2 AND WishlistItems.product_id = $3;", wishlistId, uid.(string), productId)
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// entries show the product's current price, stock and status, removed products stay on the list flagged
+func wishlistItems(db *sql.DB, wishlistId string) ([]wishlistItem, error) {
+	items := []wishlistItem{}
+	rows, err := db.Query("SELECT Products.id, Products.name, Products.quantity, Products.price, Products.status, WishlistItems.created"+
+		" FROM WishlistItems JOIN Products ON Products.id = WishlistItems.product_id WHERE WishlistItems.wishlist_id = $1"+
+		" ORDER BY WishlistItems.created DESC;", wishlistId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item wishlistItem
+		if err := rows.Scan(&item.Product, &item.Name, &item.Quantity, &item.Price, &item.Status, &item.Added); err != nil {
+			return nil, err
+		}
+		item.Active = item.Status == "A"
+		item.Removed = item.Status == "R"
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func shareToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
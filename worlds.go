@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// requests without a world use the one every existing row was migrated into
+const defaultWorld = "1"
+
+// names start with a letter so they never look like ids
+var worldName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,63}$`)
+
+// tables copied when a world is cloned, parents before children. refs maps each foreign key column to the
+// table it points at, rows of tables without a world_id column are picked through those references.
+// nullable columns end the table name with ? and do not exclude rows
+var worldTables = []struct {
+	name   string
+	serial bool
+	world  bool
+	refs   map[string]string
+	reset  string
+}{
+	{"Users", true, true, nil, ""},
+	{"Firebase", false, true, map[string]string{"id": "Users"}, ""},
+	{"Cards", true, true, map[string]string{"user_id": "Users"}, ""},
+	{"Products", true, true, map[string]string{"card_id": "Cards", "moderator_id": "Users?"}, ""},
+	{"Orders", true, true, map[string]string{"card_id": "Cards", "product_id": "Products"}, ""},
+	{"Reviews", true, false, map[string]string{"user_id": "Users", "product_id": "Products"}, ""},
+	{"ReviewVotes", false, false, map[string]string{"review_id": "Reviews", "user_id": "Users"}, ""},
+	{"ReviewReplies", false, false, map[string]string{"review_id": "Reviews", "user_id": "Users"}, ""},
+	//share links point at the original world, the copies start private
+	{"Wishlists", true, false, map[string]string{"user_id": "Users"}, ", 'share_token', NULL, 'public', FALSE"},
+	{"WishlistItems", false, false, map[string]string{"wishlist_id": "Wishlists", "product_id": "Products"}, ""},
+	{"PricingRules", false, false, map[string]string{"product_id": "Products"}, ""},
+	{"PriceChanges", true, false, map[string]string{"product_id": "Products"}, ""},
+	{"UserRoles", false, false, map[string]string{"user_id": "Users"}, ""},
+	{"Bans", true, false, map[string]string{"user_id": "Users", "moderator_id": "Users?", "lifted_by": "Users?"}, ""},
+	{"BanAppeals", true, false, map[string]string{"ban_id": "Bans", "user_id": "Users", "resolver_id": "Users?"}, ""},
+}
+
+// picks the world from the /worlds/:world prefix or the X-World header, by id or name
+func selectWorld(c *gin.Context, db *sql.DB) {
+	world := c.Param("world")
+	if world == "" {
+		world = c.GetHeader("X-World")
+	}
+	id, err := findWorld(db, world)
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		c.Abort()
+		return
+	}
+	c.Set("world", id)
+	c.Next()
+}
+
+// id of the world with the given id or name, the default world if empty
+func findWorld(db *sql.DB, world string) (string, error) {
+	if world == "" {
+		return defaultWorld, nil
+	}
+	var id string
+	err := db.QueryRow("SELECT id FROM Worlds WHERE id::text = $1 OR name = $1;", world).Scan(&id)
+	return id, err
+}
+
+// world id set by selectWorld
+func worldOf(c *gin.Context) string {
+	if world := c.GetString("world"); world != "" {
+		return world
+	}
+	return defaultWorld
+}
+
+// copies the users, cards, listings, orders and everything attached to them into a new world.
+// events and economy snapshots are history of the source world and are not copied
+func cloneWorld(ctx context.Context, db *sql.DB, source string, name string) (string, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var world string
+	if err := tx.QueryRowContext(ctx, "INSERT INTO Worlds(name, created) VALUES($1, $2) ON CONFLICT (name) DO NOTHING RETURNING id;", name, clock.Now()).Scan(&world); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE world_ids(tbl TEXT, old INTEGER, new INTEGER, PRIMARY KEY(tbl, old)) ON COMMIT DROP;"); err != nil {
+		return "", err
+	}
+
+	for _, table := range worldTables {
+		columns := make([]string, 0, len(table.refs))
+		for column := range table.refs {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		joins, overrides := "", "'world_id', $2::integer"
+		for _, column := range columns {
+			ref, nullable := strings.CutSuffix(table.refs[column], "?")
+			join := " JOIN"
+			if nullable {
+				join = " LEFT JOIN"
+			}
+			joins += join + " world_ids AS " + column + "_ids ON " + column + "_ids.tbl = '" + ref + "' AND " +
+				column + "_ids.old = t." + column
+			overrides += ", '" + column + "', " + column + "_ids.new"
+		}
+		filter := " WHERE $1::integer IS NOT NULL"
+		if table.world {
+			filter = " WHERE t.world_id = $1"
+		}
+		if table.serial {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO world_ids SELECT '"+table.name+"', t.id, nextval(pg_get_serial_sequence('"+
+				table.name+"', 'id')) FROM "+table.name+" AS t"+joins+filter+";", source); err != nil {
+				return "", err
+			}
+			joins += " JOIN world_ids AS self_ids ON self_ids.tbl = '" + table.name + "' AND self_ids.old = t.id"
+			overrides += ", 'id', self_ids.new"
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+table.name+" SELECT (jsonb_populate_record(NULL::"+table.name+", to_jsonb(t) || jsonb_build_object("+
+			overrides+table.reset+"))).* FROM "+table.name+" AS t"+joins+filter+";", source, world); err != nil {
+			return "", err
+		}
+	}
+	return world, tx.Commit()
+}
+
+func worldsGet(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var worlds []struct {
+		Id        string `json:"id"`
+		Name      string `json:"name"`
+		Timestamp string `json:"timestamp"`
+	}
+	rows, err := db.Query("SELECT id, name, created FROM Worlds ORDER BY id;")
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var world struct {
+			Id        string `json:"id"`
+			Name      string `json:"name"`
+			Timestamp string `json:"timestamp"`
+		}
+		if err := rows.Scan(&world.Id, &world.Name, &world.Timestamp); err != nil {
+			fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		worlds = append(worlds, world)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"worlds": worlds})
+}
+
+// empty world, users join it through /worlds/:world/signup
+func worldPost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var world struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.BindJSON(&world); err != nil {
+		return
+	}
+	if !worldName.MatchString(world.Name) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	var id string
+	err = tx.QueryRowContext(ctx, "INSERT INTO Worlds(name, created) VALUES($1, $2) ON CONFLICT (name) DO NOTHING RETURNING id;", world.Name, clock.Now()).Scan(&id)
+	if err == sql.ErrNoRows {
+		fail(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := audit(ctx, tx, id, c.GetString(userKey), auditWorldCreate, "world", id, nil, map[string]any{"name": world.Name}); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"id": id, "name": world.Name})
+}
+
+// copy of the selected world under a new name
+func worldClonePost(c *gin.Context, db *sql.DB, rdb *redis.Client) {
+	var world struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.BindJSON(&world); err != nil {
+		return
+	}
+	if !worldName.MatchString(world.Name) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	//the caller was authenticated in the default world, the path names the world to copy
+	source, err := findWorld(db, c.Param("world"))
+	if err != nil {
+		fail(c, http.StatusNotFound, err)
+		return
+	}
+	id, err := cloneWorld(c.Request.Context(), db, source, world.Name)
+	if err == sql.ErrNoRows {
+		fail(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := audit(c.Request.Context(), db, id, c.GetString(userKey), auditWorldClone, "world", id, map[string]any{"source": source},
+		map[string]any{"name": world.Name}); err != nil {
+		fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"id": id, "name": world.Name})
+}